@@ -0,0 +1,153 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/miekg/dns"
+)
+
+// Automatically generated A/AAAA records for the sites served by Caddy's
+// "http" app.
+type AddressRecords struct {
+	// The addresses to point the sites to.
+	// If not set, the addresses the server is bound to are used, and if it
+	// is bound to all addresses, the public addresses of this host.
+	Addresses []string `json:"addresses,omitempty"`
+
+	// The TTL of the generated records, in seconds. Defaults to 3600.
+	TTL uint32 `json:"ttl,omitempty"`
+}
+
+// Detects the public addresses of all network interfaces of this host
+func public_addresses() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ip_net, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ip_net.IP
+		if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func address_record(name string, ip net.IP, ttl uint32) dns.RR {
+	if v4 := ip.To4(); v4 != nil {
+		return &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			A: v4,
+		}
+	}
+	return &dns.AAAA{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeAAAA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		AAAA: ip,
+	}
+}
+
+// Generates the A/AAAA records for all sites in the given zones, unless
+// there already are (static) records of that type for the site.
+func (r *AddressRecords) records(
+	app *caddyhttp.App,
+	zones []string,
+	static []dns.RR,
+) ([]dns.RR, error) {
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = 3600
+	}
+
+	configured := []net.IP{}
+	for _, addr := range r.Addresses {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address '%s'", addr)
+		}
+		configured = append(configured, ip)
+	}
+	var detected []net.IP
+
+	exists := map[key]bool{}
+	for _, record := range static {
+		exists[rr_key(record)] = true
+	}
+
+	records := []dns.RR{}
+	for _, site := range http_sites(app) {
+		if _, ok := zone_of(site.host, zones); !ok {
+			continue
+		}
+		ips := configured
+		if len(ips) == 0 {
+			ips = site.ips
+		}
+		if len(ips) == 0 {
+			if detected == nil {
+				var err error
+				detected, err = public_addresses()
+				if err != nil {
+					return nil, err
+				}
+			}
+			ips = detected
+		}
+		for _, ip := range ips {
+			record := address_record(site.host, ip, ttl)
+			if exists[rr_key(record)] {
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// Parses the block of the "address_records" subdirective
+func (r *AddressRecords) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			r.Addresses = append(r.Addresses, d.Val())
+			r.Addresses = append(r.Addresses, d.RemainingArgs()...)
+		case "ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			r.TTL = uint32(ttl)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized address records subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -1,12 +1,18 @@
 package stub
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
 
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -16,14 +22,103 @@ type App struct {
 	// the address & port on which to serve DNS for the challenge
 	Address string `json:"address,omitempty"`
 
-	// Statically configured set of records to serve
+	// Statically configured set of records to serve.
+	// Records may contain placeholders, which are expanded when the app is
+	// provisioned. The {iface.<name>.ipv4} and {iface.<name>.ipv6}
+	// placeholders expand to the address of a network interface (or the one
+	// of the default route, for the name "default").
 	Records []string `json:"records,omitempty"`
 
-	ctx    *caddy.Context // set in Provision()
-	logger *zap.Logger    // set in Provision()
+	// Records served instead of the other records to clients on some
+	// networks (split-horizon DNS). The first matching view applies.
+	Views []View `json:"views,omitempty"`
+
+	// Records synthesized for names that match patterns. The first
+	// matching template applies.
+	Templates []Template `json:"templates,omitempty"`
+
+	// Records served to clients in some countries or continents
+	GeoIP *GeoIP `json:"geoip,omitempty"`
+
+	// Synthesize PTR records for the addresses in some prefixes from the
+	// A/AAAA records
+	Reverse *Reverse `json:"reverse,omitempty"`
+
+	// How to handle the EDNS Client Subnet (RFC 7871) of queries: "use" it
+	// to select GeoIP records (the default), "ignore" it and use the
+	// address of the client instead, or "strip" it from forwarded queries
+	// as well, for privacy. Views are never selected by the client subnet.
+	ClientSubnet string `json:"client_subnet,omitempty"`
+
+	// The networks (in CIDR notation) or addresses of the resolvers whose
+	// client subnets are used. The client subnets of other clients are
+	// ignored, since they could claim to be in any network.
+	TrustedResolvers []string `json:"trusted_resolvers,omitempty"`
+
+	// Zone files to load records from, e.g. zones that were signed with
+	// DNSSEC offline
+	ZoneFiles []ZoneFile `json:"zone_files,omitempty"`
+
+	// How often to check whether the addresses of the network interfaces
+	// used in records have changed. Defaults to 1 minute.
+	InterfaceInterval caddy.Duration `json:"interface_interval,omitempty"`
+
+	// The zones this server is authoritative for.
+	// Defaults to the owner names of all SOA records in Records.
+	Zones []string `json:"zones,omitempty"`
+
+	// TSIG keys, used to authenticate dynamic updates (RFC 2136)
+	Keys []TSIGKey `json:"tsig_keys,omitempty"`
+
+	// Zones to transfer from primary servers
+	Secondaries []Secondary `json:"secondaries,omitempty"`
+
+	// Sign the zones with DNSSEC
+	DNSSEC *DNSSEC `json:"dnssec,omitempty"`
+
+	// Allow zone transfers to secondary servers
+	Transfer *Transfer `json:"transfer,omitempty"`
+
+	// Forward queries for names the server doesn't hold to a backend
+	Forward *Forward `json:"forward,omitempty"`
+
+	// Resolve queries for names the server doesn't hold for clients on
+	// the allowed networks, with caching
+	Resolver *Resolver `json:"resolver,omitempty"`
+
+	// Only serve records while the servers they point to are healthy
+	Health *HealthChecks `json:"health_checks,omitempty"`
+
+	// Don't add the addresses of the targets of NS, MX & SRV records to the
+	// additional section of answers. Glue for referrals is always added.
+	MinimalResponses bool `json:"minimal_responses,omitempty"`
+
+	// How the records of RRsets are ordered in answers
+	AnswerOrders []AnswerOrder `json:"answer_orders,omitempty"`
+
+	// Generate CAA records for the zones, based on the ACME issuers
+	// configured in the "tls" app
+	CAA *CAA `json:"caa,omitempty"`
+
+	// Generate HTTPS records for the sites served by the "http" app
+	HTTPSRecords *HTTPSRecords `json:"https_records,omitempty"`
+
+	// Generate A/AAAA records for the sites served by the "http" app
+	AddressRecords *AddressRecords `json:"address_records,omitempty"`
+
+	// Publish TLSA records for certificates managed by the "tls" app
+	TLSA *TLSA `json:"tlsa,omitempty"`
+
+	ctx    *caddy.Context  // set in Provision()
+	logger *zap.Logger     // set in Provision()
+	static []static_record // set in Provision()
+	dyndns *dyndns_records // set in Provision(), loaded by DynDNS handlers
+
+	trusted_resolvers []*net.IPNet // set in Provision()
 
 	requests chan request  // set in Provision()
 	shutdown chan struct{} // set in Provision()
+	stopped  chan struct{} // set in Start(), once the server is running
 }
 
 func (App) CaddyModule() caddy.ModuleInfo {
@@ -36,6 +131,7 @@ func (App) CaddyModule() caddy.ModuleInfo {
 // Provision sets up the module. Implements caddy.Provisioner.
 func (a *App) Provision(ctx caddy.Context) error {
 	a.logger = ctx.Logger()
+	a.ctx = &ctx
 	if a.requests == nil {
 		a.requests = make(chan request)
 	}
@@ -45,9 +141,125 @@ func (a *App) Provision(ctx caddy.Context) error {
 	if a.shutdown == nil {
 		a.shutdown = make(chan struct{})
 	}
+	if a.dyndns == nil {
+		a.dyndns = &dyndns_records{}
+	}
 	if a.Address == "" {
 		a.Address = ":53"
 	}
+	if a.InterfaceInterval == 0 {
+		a.InterfaceInterval = caddy.Duration(time.Minute)
+	}
+	for i := range a.Keys {
+		err := a.Keys[i].provision()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range a.Views {
+		err := a.Views[i].provision()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range a.Templates {
+		err := a.Templates[i].provision()
+		if err != nil {
+			return err
+		}
+	}
+	if err := valid_subnet_policy(a.ClientSubnet); err != nil {
+		return err
+	}
+	trusted_resolvers, err := parse_networks(a.TrustedResolvers)
+	if err != nil {
+		return err
+	}
+	a.trusted_resolvers = trusted_resolvers
+	if a.GeoIP != nil {
+		err := a.GeoIP.provision()
+		if err != nil {
+			return err
+		}
+	}
+	if a.Reverse != nil {
+		err := a.Reverse.provision()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range a.Secondaries {
+		err := a.Secondaries[i].provision(a.logger, a.Keys)
+		if err != nil {
+			return err
+		}
+	}
+	if a.DNSSEC != nil {
+		err := a.DNSSEC.provision()
+		if err != nil {
+			return err
+		}
+	}
+	if a.Transfer != nil {
+		err := a.Transfer.provision()
+		if err != nil {
+			return err
+		}
+	}
+	if a.Forward != nil {
+		err := a.Forward.provision(a.logger)
+		if err != nil {
+			return err
+		}
+	}
+	if a.Resolver != nil {
+		err := a.Resolver.provision(a.logger)
+		if err != nil {
+			return err
+		}
+	}
+	if a.Health != nil {
+		err := a.Health.provision(a.logger)
+		if err != nil {
+			return err
+		}
+	}
+	orders := map[key]bool{}
+	for i := range a.AnswerOrders {
+		order := &a.AnswerOrders[i]
+		err := order.provision()
+		if err != nil {
+			return err
+		}
+		if orders[order.key] {
+			return fmt.Errorf("multiple answer orders for %s %s", order.Name, order.Type)
+		}
+		orders[order.key] = true
+	}
+	static, err := parse_records(a.Records)
+	if err != nil {
+		return err
+	}
+	for _, file := range a.ZoneFiles {
+		records, err := file.load()
+		if err != nil {
+			return fmt.Errorf("loading zone file '%s': %v", file.Path, err)
+		}
+		static = append(static, records...)
+	}
+	a.static = static
+	if a.CAA != nil {
+		err := a.CAA.provision(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if a.TLSA != nil {
+		err := a.TLSA.provision(ctx)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -65,32 +277,253 @@ func (a *App) Start() error {
 		ctx:      a.ctx,
 		requests: a.requests,
 		Records:  make(map[key][]dns.RR),
+		Keys:     make(map[string]*TSIGKey),
+		Transfer: a.Transfer,
+		Forward:  a.Forward,
+		Resolver: a.Resolver,
+		GeoIP:    a.GeoIP,
+		Reverse:  a.Reverse,
+
+		ClientSubnet:      a.ClientSubnet,
+		trusted_resolvers: a.trusted_resolvers,
+		journals:          make(map[string][]journal_entry),
+
+		addresses:          address_index{},
+		override_addresses: address_index{},
+
+		MinimalResponses: a.MinimalResponses,
+
+		secondaries: make(map[string]*Secondary),
 	}
-	for _, record_string := range a.Records {
-		record, err := dns.NewRR(record_string)
-		if err != nil {
-			return err
+	for i := range a.Keys {
+		srv.Keys[a.Keys[i].Name] = &a.Keys[i]
+	}
+	for i := range a.Views {
+		srv.views = append(srv.views, &a.Views[i])
+		for _, rrset := range a.Views[i].overrides {
+			for _, rr := range rrset {
+				srv.override_addresses.add(rr)
+			}
 		}
-		srv.insert_record(record)
 	}
-	if len(a.Records) > 0 {
-		a.logger.Debug("loaded records", zap.Int("count", len(a.Records)))
+	if a.GeoIP != nil {
+		for _, record := range a.GeoIP.Records {
+			srv.override_addresses.add(record.rr)
+		}
+	}
+	for i := range a.Templates {
+		srv.templates = append(srv.templates, &a.Templates[i])
+	}
+	srv.orders = make(map[key]*AnswerOrder)
+	for i := range a.AnswerOrders {
+		srv.orders[a.AnswerOrders[i].key] = &a.AnswerOrders[i]
+	}
+	static := []dns.RR{}
+	dynamic := false
+	for _, record := range a.static {
+		static = append(static, record.rr)
+		srv.insert_record(record.rr)
+		dynamic = dynamic || record.dynamic
+	}
+	if len(a.static) > 0 {
+		a.logger.Debug("loaded records", zap.Int("count", len(a.static)))
 	} else {
 		a.logger.Debug("no records loaded")
 	}
+	if a.Health != nil {
+		// all records are served until the first checks have run
+		for _, record := range a.Health.initial_records() {
+			static = append(static, record)
+			srv.insert_record(record)
+		}
+	}
+
+	srv.Zones = a.zones(static)
+	for i := range a.Secondaries {
+		secondary := &a.Secondaries[i]
+		srv.secondaries[secondary.Zone] = secondary
+		srv.Zones = append(srv.Zones, secondary.Zone)
+	}
+	generated, err := a.generate_records(static, srv.Zones)
+	if err != nil {
+		return err
+	}
+	for _, record := range generated {
+		srv.insert_record(record)
+	}
+	a.dyndns.mu.Lock()
+	for _, records := range a.dyndns.current {
+		for _, record := range records {
+			srv.insert_record(record)
+		}
+	}
+	a.dyndns.mu.Unlock()
+
+	if a.DNSSEC != nil {
+		srv.signers, err = a.DNSSEC.signers(a.ctx, a.ctx.Storage(), a.logger, srv.Zones)
+		if err != nil {
+			return err
+		}
+		for _, signer := range srv.signers {
+			for _, record := range signer.published {
+				srv.insert_record(record)
+			}
+		}
+	}
+
+	if a.TLSA != nil {
+		records, err := a.TLSA.update(a.ctx)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			srv.insert_record(record)
+		}
+		a.TLSA.published = records
+		a.logger.Debug("generated TLSA records", zap.Int("count", len(records)))
+	}
+
+	// the initial records are not changes to the zones
+	srv.reset_changes()
+	srv.init_serials()
 
 	err = srv.start_stop_server()
 	if err != nil {
 		return err
 	}
+	srv.notify_all()
+	srv.stopped = make(chan struct{})
+	a.stopped = srv.stopped
 	go srv.main()
 
+	if a.CAA != nil && a.CAA.zones != nil {
+		go a.CAA.run(a)
+	}
+	if a.TLSA != nil {
+		go a.TLSA.run(a)
+	}
+	for i := range a.Secondaries {
+		go a.Secondaries[i].run(a)
+	}
+	if a.DNSSEC != nil {
+		go a.DNSSEC.run(a, srv.signers)
+	}
+	if a.Health != nil {
+		go a.Health.run(a)
+	}
+	if dynamic {
+		go a.watch_interfaces()
+	}
+
 	return nil
 }
 
+// Atomically replaces records the app has generated itself
+func (a *App) replace(previous []dns.RR, records []dns.RR) error {
+	resp := make(chan error)
+	req := request{
+		append:    true,
+		records:   records,
+		replaces:  previous,
+		responder: resp,
+	}
+	select {
+	case a.requests <- req:
+	case <-a.shutdown:
+		return errors.New("app stopped")
+	}
+	return <-resp
+}
+
+// The zones the server is authoritative for, either configured explicitly or
+// derived from the SOA records.
+func (a *App) zones(records []dns.RR) []string {
+	if len(a.Zones) > 0 {
+		zones := []string{}
+		for _, zone := range a.Zones {
+			zones = append(zones, dns.CanonicalName(zone))
+		}
+		return zones
+	}
+	zones := []string{}
+	for _, record := range records {
+		if record.Header().Rrtype == dns.TypeSOA {
+			zones = append(zones, dns.CanonicalName(record.Header().Name))
+		}
+	}
+	return zones
+}
+
+// Generates the records that are derived from the configuration of Caddy
+// (and its other apps), rather than configured explicitly.
+func (a *App) generate_records(static []dns.RR, zones []string) ([]dns.RR, error) {
+	generated := []dns.RR{}
+
+	if a.CAA != nil {
+		if len(zones) == 0 {
+			a.logger.Warn("no zones configured, not generating CAA records")
+		} else if !a.ctx.AppIsConfigured("tls") {
+			a.logger.Warn("TLS app not configured, not generating CAA records")
+		} else {
+			app, err := a.ctx.App("tls")
+			if err != nil {
+				return nil, err
+			}
+			records, err := a.CAA.records(
+				a.ctx,
+				a.logger,
+				app.(*caddytls.TLS),
+				a.ctx.Storage(),
+				zones,
+			)
+			if err != nil {
+				return nil, err
+			}
+			a.logger.Debug("generated CAA records", zap.Int("count", len(records)))
+			generated = append(generated, records...)
+			a.CAA.zones = zones
+			a.CAA.published = records
+		}
+	}
+
+	if a.HTTPSRecords != nil || a.AddressRecords != nil {
+		if len(zones) == 0 {
+			a.logger.Warn("no zones configured, not generating records for sites")
+		} else if !a.ctx.AppIsConfigured("http") {
+			a.logger.Warn("HTTP app not configured, not generating records for sites")
+		} else {
+			app, err := a.ctx.App("http")
+			if err != nil {
+				return nil, err
+			}
+			http_app := app.(*caddyhttp.App)
+			if a.HTTPSRecords != nil {
+				records := a.HTTPSRecords.records(http_app, zones)
+				a.logger.Debug("generated HTTPS records", zap.Int("count", len(records)))
+				generated = append(generated, records...)
+			}
+			if a.AddressRecords != nil {
+				records, err := a.AddressRecords.records(http_app, zones, static)
+				if err != nil {
+					return nil, err
+				}
+				a.logger.Debug("generated address records", zap.Int("count", len(records)))
+				generated = append(generated, records...)
+			}
+		}
+	}
+
+	return generated, nil
+}
+
 func (a *App) Stop() error {
 	a.logger.Debug("stopping app")
 	close(a.shutdown)
+	if a.stopped != nil {
+		// the servers have to release the address before a new
+		// configuration is served
+		<-a.stopped
+	}
 	return nil
 }
 
@@ -99,6 +532,104 @@ func (a *App) Stop() error {
 //	dns [address] {
 //	    bind <address>
 //	    [record "<record>"]
+//	    [zone_file <path> [<origin>]]
+//	    [view [<name>] {
+//	        network <network...>
+//	        [record "<record>"]
+//	    }]
+//	    [template <pattern> [<record...>] {
+//	        [record "<record>"]
+//	    }]
+//	    [geoip <database> {
+//	        [record "<record>" {
+//	            [country <code...>]
+//	            [continent <code...>]
+//	        }]
+//	    }]
+//	    [reverse [<prefix...>] {
+//	        [prefix <prefix...>]
+//	        [fallback <name>]
+//	        [ttl <seconds>]
+//	    }]
+//	    [client_subnet use|ignore|strip]
+//	    [trusted_resolvers <network...>]
+//	    [interface_interval <duration>]
+//	    [zone <zone...>]
+//	    [minimal_responses]
+//	    [answer_order <name> <type> fixed|round_robin|random|weighted {
+//	        [weight <data> <weight>]
+//	        [count <count>]
+//	    }]
+//	    [tsig_key <name> <secret> {
+//	        [algorithm <algorithm>]
+//	        [update]
+//	        [update_names <name...>]
+//	        [update_types <type...>]
+//	    }]
+//	    [secondary <zone> [<primary...>] {
+//	        [primary <address...>]
+//	        [key <name>]
+//	    }]
+//	    [dnssec {
+//	        [zone <zone...>]
+//	        [algorithm <algorithm>]
+//	        [validity <duration>]
+//	        [ttl <seconds>]
+//	        [zsk_lifetime <duration>]
+//	        [ksk_lifetime <duration>]
+//	        [propagation_delay <duration>]
+//	        [parent_delay <duration>]
+//	        [ds_ttl <duration>]
+//	    }]
+//	    [transfer {
+//	        [zone <zone...>]
+//	        [allow <network...>]
+//	        [key <name...>]
+//	        [notify <address...>]
+//	    }]
+//	    [forward [<upstream...>] {
+//	        [upstream <address...>]
+//	        [timeout <duration>]
+//	        [attempts <count>]
+//	    }]
+//	    [resolver [<upstream...>] {
+//	        [upstream <address...>]
+//	        allow <network...>
+//	        [timeout <duration>]
+//	        [attempts <count>]
+//	        [cache_size <count>]
+//	        [serve_stale <duration>]
+//	        [prefetch]
+//	    }]
+//	    [health_checks {
+//	        [interval <duration>]
+//	        [timeout <duration>]
+//	        [record "<record>" {
+//	            [upstream <dial address>]
+//	            [http <url>]
+//	            [tcp <address>]
+//	            [fallback]
+//	        }]
+//	    }]
+//	    [caa {
+//	        [issuer_domain <directory URL> <domain>]
+//	        [critical]
+//	        [ttl <seconds>]
+//	    }]
+//	    [https_records {
+//	        [ttl <seconds>]
+//	    }]
+//	    [address_records {
+//	        [address <ip...>]
+//	        [ttl <seconds>]
+//	    }]
+//	    [tlsa {
+//	        [service <name> <port> [<protocol>]]
+//	        [exclude_issuer]
+//	        [retain <duration>]
+//	        [interval <duration>]
+//	        [ttl <seconds>]
+//	    }]
 //	}
 func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
@@ -130,20 +661,230 @@ func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 			case "record":
 				if d.NextArg() {
-					rr, err := dns.NewRR(d.Val())
-					if err != nil {
-						return d.WrapErr(err)
+					if strings.ContainsAny(d.Val(), "{}") {
+						// placeholders are only expanded at runtime
+						a.Records = append(a.Records, d.Val())
+					} else {
+						rr, err := dns.NewRR(d.Val())
+						if err != nil {
+							return d.WrapErr(err)
+						}
+						if rr == nil {
+							return d.Err("invalid empty record")
+						}
+						a.Records = append(a.Records, rr.String())
 					}
-					if rr == nil {
-						return d.Err("invalid empty record")
-					}
-					a.Records = append(a.Records, rr.String())
 				} else {
 					return d.ArgErr()
 				}
 				if d.NextArg() {
 					return d.ArgErr()
 				}
+			case "secondary":
+				var secondary Secondary
+				err := secondary.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+				a.Secondaries = append(a.Secondaries, secondary)
+			case "dnssec":
+				if a.DNSSEC != nil {
+					return d.Err("DNSSEC already configured")
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.DNSSEC = &DNSSEC{}
+				err := a.DNSSEC.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "view":
+				var view View
+				err := view.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+				a.Views = append(a.Views, view)
+			case "template":
+				var template Template
+				err := template.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+				a.Templates = append(a.Templates, template)
+			case "geoip":
+				if a.GeoIP != nil {
+					return d.Err("GeoIP already configured")
+				}
+				a.GeoIP = &GeoIP{}
+				err := a.GeoIP.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "reverse":
+				if a.Reverse != nil {
+					return d.Err("reverse records already configured")
+				}
+				a.Reverse = &Reverse{}
+				err := a.Reverse.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "client_subnet":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.ClientSubnet = d.Val()
+				if err := valid_subnet_policy(a.ClientSubnet); err != nil {
+					return d.WrapErr(err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "trusted_resolvers":
+				values := d.RemainingArgs()
+				if len(values) == 0 {
+					return d.ArgErr()
+				}
+				a.TrustedResolvers = append(a.TrustedResolvers, values...)
+			case "zone_file":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				file := ZoneFile{Path: args[0]}
+				if len(args) == 2 {
+					file.Origin = args[1]
+				}
+				a.ZoneFiles = append(a.ZoneFiles, file)
+			case "transfer":
+				if a.Transfer != nil {
+					return d.Err("transfers already configured")
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.Transfer = &Transfer{}
+				err := a.Transfer.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "forward":
+				if a.Forward != nil {
+					return d.Err("forwarding already configured")
+				}
+				a.Forward = &Forward{}
+				err := a.Forward.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "resolver":
+				if a.Resolver != nil {
+					return d.Err("resolver already configured")
+				}
+				a.Resolver = &Resolver{}
+				err := a.Resolver.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "health_checks":
+				if a.Health != nil {
+					return d.Err("health checks already configured")
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.Health = &HealthChecks{}
+				err := a.Health.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "tsig_key":
+				var key TSIGKey
+				err := key.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+				a.Keys = append(a.Keys, key)
+			case "interface_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				a.InterfaceInterval = caddy.Duration(interval)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "zone":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.Zones = append(a.Zones, d.Val())
+				a.Zones = append(a.Zones, d.RemainingArgs()...)
+			case "minimal_responses":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.MinimalResponses = true
+			case "answer_order":
+				var order AnswerOrder
+				err := order.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+				a.AnswerOrders = append(a.AnswerOrders, order)
+			case "https_records":
+				if a.HTTPSRecords != nil {
+					return d.Err("HTTPS records already configured")
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.HTTPSRecords = &HTTPSRecords{}
+				err := a.HTTPSRecords.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "address_records":
+				if a.AddressRecords != nil {
+					return d.Err("address records already configured")
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AddressRecords = &AddressRecords{}
+				err := a.AddressRecords.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "tlsa":
+				if a.TLSA != nil {
+					return d.Err("TLSA already configured")
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.TLSA = &TLSA{}
+				err := a.TLSA.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
+			case "caa":
+				if a.CAA != nil {
+					return d.Err("CAA already configured")
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.CAA = &CAA{}
+				err := a.CAA.unmarshal_caddyfile(d)
+				if err != nil {
+					return err
+				}
 			default:
 				return d.Errf("unrecognized subdirective '%s'", d.Val())
 			}
@@ -161,6 +902,28 @@ func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 //	dns [address] {
 //	    bind <address>
 //	    [record <record>]
+//	    [zone_file <path> [<origin>]]
+//	    [view [<name>] { ... }]
+//	    [template <pattern> [<record...>] { ... }]
+//	    [geoip <database> { ... }]
+//	    [reverse [<prefix...>] { ... }]
+//	    [client_subnet use|ignore|strip]
+//	    [trusted_resolvers <network...>]
+//	    [interface_interval <duration>]
+//	    [zone <zone...>]
+//	    [minimal_responses]
+//	    [answer_order <name> <type> <policy> { ... }]
+//	    [tsig_key <name> <secret> { ... }]
+//	    [secondary <zone> [<primary...>] { ... }]
+//	    [dnssec { ... }]
+//	    [transfer { ... }]
+//	    [forward [<upstream...>] { ... }]
+//	    [resolver [<upstream...>] { ... }]
+//	    [health_checks { ... }]
+//	    [caa { ... }]
+//	    [https_records { ... }]
+//	    [address_records { ... }]
+//	    [tlsa { ... }]
 //	}
 func parseApp(d *caddyfile.Dispenser, prev interface{}) (interface{}, error) {
 	var a App
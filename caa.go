@@ -0,0 +1,342 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/caddyserver/certmagic"
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Automatically generated CAA records, restricting certificate issuance for
+// the served zones to the ACME CAs, accounts and validation methods that
+// Caddy's "tls" app is configured with.
+type CAA struct {
+	// The CAA issuer domains of ACME CAs, by directory URL.
+	// Extends (and overrides) the built-in list of well-known CAs.
+	IssuerDomains map[string]string `json:"issuer_domains,omitempty"`
+
+	// Set the "issuer critical" flag on the generated records
+	Critical bool `json:"critical,omitempty"`
+
+	// The TTL of the generated records, in seconds. Defaults to 3600.
+	TTL uint32 `json:"ttl,omitempty"`
+
+	refresh chan struct{} // set in provision()
+
+	zones     []string // set in App.generate_records()
+	published []dns.RR // set in App.generate_records(), then owned by run()
+}
+
+func (c *CAA) provision(ctx caddy.Context) error {
+	c.refresh = make(chan struct{}, 1)
+	app, err := ctx.App("events")
+	if err != nil {
+		return err
+	}
+	// the account is registered right before the first certificate is
+	// obtained, its URI is only known afterwards
+	return app.(*caddyevents.App).On("cert_obtained", refresh_handler{c.refresh})
+}
+
+// CAA issuer domains of well-known ACME CAs, by the host of their directory
+var known_issuer_domains = map[string]string{
+	"acme-v02.api.letsencrypt.org":         "letsencrypt.org",
+	"acme-staging-v02.api.letsencrypt.org": "letsencrypt.org",
+	"acme.zerossl.com":                     "sectigo.com",
+	"dv.acme-v02.api.pki.goog":             "pki.goog",
+	"dv.acme-v02.test-api.pki.goog":        "pki.goog",
+	"acme.ssl.com":                         "ssl.com",
+	"api.buypass.com":                      "buypass.com",
+	"api.test4.buypass.no":                 "buypass.com",
+}
+
+// An ACME issuer, as far as CAA is concerned
+type caa_issuer struct {
+	ca      string
+	email   string
+	methods []string
+}
+
+func (c *CAA) issuer_domain(ca string) (string, error) {
+	if domain, ok := c.IssuerDomains[ca]; ok {
+		return domain, nil
+	}
+	parsed, err := url.Parse(ca)
+	if err != nil {
+		return "", err
+	}
+	if domain, ok := known_issuer_domains[parsed.Hostname()]; ok {
+		return domain, nil
+	}
+	return "", fmt.Errorf("unknown CAA issuer domain for CA '%s'", ca)
+}
+
+// Collects the ACME issuers from the automation policies of the "tls" app.
+// If there are none, the issuers Caddy uses by default are assumed.
+func acme_issuers(tls_app *caddytls.TLS) []caa_issuer {
+	issuers := []certmagic.Issuer{}
+	if tls_app.Automation != nil {
+		for _, policy := range tls_app.Automation.Policies {
+			issuers = append(issuers, policy.Issuers...)
+		}
+	}
+	if len(issuers) == 0 {
+		issuers = caddytls.DefaultIssuers()
+	}
+
+	type acme_capable interface {
+		GetACMEIssuer() *caddytls.ACMEIssuer
+	}
+	result := []caa_issuer{}
+	seen := map[string]bool{}
+	for _, iss := range issuers {
+		capable, ok := iss.(acme_capable)
+		if !ok {
+			continue
+		}
+		acme_iss := capable.GetACMEIssuer()
+		if acme_iss == nil {
+			continue
+		}
+		ca := acme_iss.CA
+		if ca == "" {
+			if _, zerossl := iss.(*caddytls.ZeroSSLIssuer); zerossl {
+				ca = certmagic.ZeroSSLProductionCA
+			} else {
+				ca = certmagic.DefaultACME.CA
+			}
+		}
+		if seen[ca+" "+acme_iss.Email] {
+			continue
+		}
+		seen[ca+" "+acme_iss.Email] = true
+		result = append(result, caa_issuer{
+			ca:      ca,
+			email:   acme_iss.Email,
+			methods: validation_methods(acme_iss.Challenges),
+		})
+	}
+	return result
+}
+
+// The ACME challenge types an issuer may use, as CAA "validationmethods"
+func validation_methods(challenges *caddytls.ChallengesConfig) []string {
+	if challenges == nil {
+		return []string{"http-01", "tls-alpn-01"}
+	}
+	if challenges.DNS != nil {
+		// certmagic only ever uses the DNS challenge when it is configured
+		return []string{"dns-01"}
+	}
+	methods := []string{}
+	if challenges.HTTP == nil || !challenges.HTTP.Disabled {
+		methods = append(methods, "http-01")
+	}
+	if challenges.TLSALPN == nil || !challenges.TLSALPN.Disabled {
+		methods = append(methods, "tls-alpn-01")
+	}
+	return methods
+}
+
+// Looks up the URIs of the accounts registered with the given CA in storage.
+// This has to mirror the storage layout used by certmagic.
+func account_uris(
+	ctx context.Context,
+	storage certmagic.Storage,
+	issuer caa_issuer,
+) ([]string, error) {
+	ca_url, err := url.Parse(issuer.ca)
+	if err != nil {
+		return nil, err
+	}
+	issuer_key := ca_url.Host
+	if p := strings.Trim(strings.ReplaceAll(ca_url.Path, "/", "-"), "-"); p != "" {
+		issuer_key += "-" + p
+	}
+	users := path.Join("acme", certmagic.StorageKeys.Safe(issuer_key), "users")
+
+	var user_dirs []string
+	if issuer.email != "" {
+		safe := certmagic.StorageKeys.Safe(strings.ToLower(issuer.email))
+		user_dirs = []string{path.Join(users, safe)}
+	} else {
+		user_dirs, err = storage.List(ctx, users, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uris := []string{}
+	for _, dir := range user_dirs {
+		files, err := storage.List(ctx, dir, false)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if path.Ext(file) != ".json" {
+				continue
+			}
+			data, err := storage.Load(ctx, file)
+			if err != nil {
+				return nil, err
+			}
+			var account acme.Account
+			err = json.Unmarshal(data, &account)
+			if err != nil {
+				return nil, err
+			}
+			if account.Location != "" {
+				uris = append(uris, account.Location)
+			}
+		}
+	}
+	return uris, nil
+}
+
+// Generates the CAA records for the given zones
+func (c *CAA) records(
+	ctx context.Context,
+	logger *zap.Logger,
+	tls_app *caddytls.TLS,
+	storage certmagic.Storage,
+	zones []string,
+) ([]dns.RR, error) {
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = 3600
+	}
+	var flag uint8
+	if c.Critical {
+		flag = 128
+	}
+
+	values := []string{}
+	for _, issuer := range acme_issuers(tls_app) {
+		domain, err := c.issuer_domain(issuer.ca)
+		if err != nil {
+			return nil, err
+		}
+		parameters := ""
+		if len(issuer.methods) > 0 {
+			parameters = "; validationmethods=" + strings.Join(issuer.methods, ",")
+		}
+		uris, err := account_uris(ctx, storage, issuer)
+		if err != nil {
+			logger.Warn(
+				"failed to look up ACME account",
+				zap.String("ca", issuer.ca),
+				zap.Error(err),
+			)
+		}
+		if len(uris) == 0 {
+			logger.Warn(
+				"no ACME account registered yet, CAA record will not include accounturi",
+				zap.String("ca", issuer.ca),
+			)
+			values = append(values, domain+parameters)
+		}
+		for _, uri := range uris {
+			values = append(values, domain+"; accounturi="+uri+parameters)
+		}
+	}
+
+	records := []dns.RR{}
+	for _, zone := range zones {
+		for _, tag := range []string{"issue", "issuewild"} {
+			for _, value := range values {
+				records = append(records, &dns.CAA{
+					Hdr: dns.RR_Header{
+						Name:   dns.Fqdn(zone),
+						Rrtype: dns.TypeCAA,
+						Class:  dns.ClassINET,
+						Ttl:    ttl,
+					},
+					Flag:  flag,
+					Tag:   tag,
+					Value: value,
+				})
+			}
+		}
+	}
+	return records, nil
+}
+
+// Regenerates the records whenever the "tls" app has obtained a certificate,
+// to add the URIs of newly registered accounts.
+func (c *CAA) run(a *App) {
+	for {
+		select {
+		case <-c.refresh:
+		case <-a.shutdown:
+			return
+		}
+		app, err := a.ctx.App("tls")
+		if err != nil {
+			a.logger.Error("failed to update CAA records", zap.Error(err))
+			continue
+		}
+		records, err := c.records(a.ctx, a.logger, app.(*caddytls.TLS), a.ctx.Storage(), c.zones)
+		if err != nil {
+			a.logger.Error("failed to update CAA records", zap.Error(err))
+			continue
+		}
+		if same_records(records, c.published) {
+			continue
+		}
+		err = a.replace(c.published, records)
+		if err != nil {
+			a.logger.Error("failed to publish CAA records", zap.Error(err))
+			continue
+		}
+		c.published = records
+	}
+}
+
+// Parses the block of the "caa" subdirective
+func (c *CAA) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "issuer_domain":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if c.IssuerDomains == nil {
+				c.IssuerDomains = map[string]string{}
+			}
+			c.IssuerDomains[args[0]] = args[1]
+		case "critical":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Critical = true
+		case "ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			c.TTL = uint32(ttl)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized CAA subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
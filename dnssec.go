@@ -0,0 +1,800 @@
+package stub
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Online DNSSEC signing of the served zones. Every zone gets a key signing
+// key (KSK) and a zone signing key (ZSK), which are generated on first use
+// and kept in Caddy's storage. Responses to queries with the DO bit set are
+// signed on the fly, and non-existence is proven with minimally covering
+// NSEC records ("black lies").
+//
+// The keys are rolled over automatically, with the timeline kept in
+// storage along with the keys. The DS record to publish at the parent zone
+// is logged on startup and whenever it changes, and published as CDS &
+// CDNSKEY records (RFC 8078).
+type DNSSEC struct {
+	// The zones to sign. Defaults to all zones.
+	Zones []string `json:"zones,omitempty"`
+
+	// The algorithm of the generated keys, either "ecdsap256sha256" or
+	// "ed25519". Defaults to "ecdsap256sha256".
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// How long signatures are valid. Defaults to 7 days.
+	Validity caddy.Duration `json:"validity,omitempty"`
+
+	// The TTL of the DNSKEY records, in seconds. Defaults to 3600.
+	TTL uint32 `json:"ttl,omitempty"`
+
+	// How long a ZSK is used before it is rolled over (by pre-publishing its
+	// successor). Defaults to 30 days.
+	ZSKLifetime caddy.Duration `json:"zsk_lifetime,omitempty"`
+
+	// How long a KSK is used before it is rolled over (by double signature).
+	// The successor is announced to the parent zone with CDS & CDNSKEY
+	// records (RFC 8078), so this should only be enabled if the parent
+	// zone picks them up. Disabled by default.
+	KSKLifetime caddy.Duration `json:"ksk_lifetime,omitempty"`
+
+	// How long it takes for changes to reach all secondary servers.
+	// Defaults to 1 hour.
+	PropagationDelay caddy.Duration `json:"propagation_delay,omitempty"`
+
+	// How long it takes for the parent zone to update the DS record after
+	// the CDS record changed. Defaults to 1 day.
+	ParentDelay caddy.Duration `json:"parent_delay,omitempty"`
+
+	// The TTL of the DS record in the parent zone. Defaults to 1 day.
+	DSTTL caddy.Duration `json:"ds_ttl,omitempty"`
+
+	algorithm uint8 // set in provision()
+}
+
+var dnssec_algorithms = map[string]uint8{
+	"ecdsap256sha256": dns.ECDSAP256SHA256,
+	"ed25519":         dns.ED25519,
+}
+
+const dnssec_storage_prefix = "dns/dnssec"
+
+// A DNSSEC key, as kept in storage, along with its rollover timeline.
+// Times that are not set are in the distant past (or future, for Retired
+// and Removed).
+type stored_key struct {
+	// The DNSKEY record, in presentation format
+	DNSKEY string `json:"dnskey"`
+
+	// The private key, in the BIND private key format
+	Private string `json:"private"`
+
+	Created time.Time `json:"created"`
+
+	// When the DNSKEY record is added to the zone
+	Published time.Time `json:"published,omitempty"`
+
+	// When the key starts signing
+	Active time.Time `json:"active,omitempty"`
+
+	// When the key stops signing
+	Retired time.Time `json:"retired,omitempty"`
+
+	// When the DNSKEY record is removed from the zone
+	Removed time.Time `json:"removed,omitempty"`
+
+	// When the CDS & CDNSKEY records start referring to the key (KSK only)
+	Submitted time.Time `json:"submitted,omitempty"`
+}
+
+func (k *stored_key) is_published(t time.Time) bool {
+	return !k.Published.After(t) && (k.Removed.IsZero() || t.Before(k.Removed))
+}
+
+func (k *stored_key) is_active(t time.Time) bool {
+	return !k.Active.After(t) && (k.Retired.IsZero() || t.Before(k.Retired))
+}
+
+// The keys of a zone, as kept in storage
+type stored_keys struct {
+	Keys []stored_key `json:"keys"`
+}
+
+// A DNSSEC key, ready for signing
+type signing_key struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// Signs the records of a zone. The keys are used by the main loop of the
+// server, and changed by DNSSEC.run().
+type zone_signer struct {
+	zone     string
+	validity time.Duration
+
+	mu      *sync.Mutex
+	ksks    []*signing_key // sign the DNSKEY, CDS & CDNSKEY RRsets
+	zsk     *signing_key   // signs all other RRsets
+	max_ttl uint32         // the largest TTL of the signed records
+
+	// signatures of RRsets that haven't changed can be reused
+	cache map[key]*cached_signature
+
+	published []dns.RR // DNSKEY, CDS & CDNSKEY records, owned by DNSSEC.run()
+	ds        string   // the DS record for the parent, owned by DNSSEC.run()
+}
+
+type cached_signature struct {
+	content string
+	rrsigs  []dns.RR
+}
+
+func (d *DNSSEC) provision() error {
+	if d.Algorithm == "" {
+		d.Algorithm = "ecdsap256sha256"
+	}
+	algorithm, ok := dnssec_algorithms[strings.ToLower(d.Algorithm)]
+	if !ok {
+		return fmt.Errorf("unsupported DNSSEC algorithm '%s'", d.Algorithm)
+	}
+	d.algorithm = algorithm
+	if d.Validity == 0 {
+		d.Validity = caddy.Duration(7 * 24 * time.Hour)
+	}
+	if d.TTL == 0 {
+		d.TTL = 3600
+	}
+	if d.ZSKLifetime == 0 {
+		d.ZSKLifetime = caddy.Duration(30 * 24 * time.Hour)
+	}
+	if d.PropagationDelay == 0 {
+		d.PropagationDelay = caddy.Duration(time.Hour)
+	}
+	if d.ParentDelay == 0 {
+		d.ParentDelay = caddy.Duration(24 * time.Hour)
+	}
+	if d.DSTTL == 0 {
+		d.DSTTL = caddy.Duration(24 * time.Hour)
+	}
+	for i, zone := range d.Zones {
+		d.Zones[i] = dns.CanonicalName(zone)
+	}
+	return nil
+}
+
+// Parses a key loaded from storage
+func (d *DNSSEC) parse_key(stored stored_key) (*signing_key, error) {
+	rr, err := dns.NewRR(stored.DNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("invalid DNSKEY record '%s'", stored.DNSKEY)
+	}
+	dnskey.Hdr.Ttl = d.TTL
+	private, err := dnskey.NewPrivateKey(stored.Private)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key for '%s'", stored.DNSKEY)
+	}
+	return &signing_key{dnskey, signer}, nil
+}
+
+// Generates a new key for the zone
+func (d *DNSSEC) generate_key(zone string, flags uint16, now time.Time) (stored_key, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    d.TTL,
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: d.algorithm,
+	}
+	private, err := dnskey.Generate(256)
+	if err != nil {
+		return stored_key{}, err
+	}
+	return stored_key{
+		DNSKEY:  dnskey.String(),
+		Private: dnskey.PrivateKeyString(private),
+		Created: now,
+	}, nil
+}
+
+func dnssec_storage_key(zone string) string {
+	name := strings.TrimSuffix(zone, ".")
+	if name == "" {
+		name = "root"
+	}
+	return path.Join(dnssec_storage_prefix, certmagic.StorageKeys.Safe(name)+".json")
+}
+
+// Advances the rollovers of the keys of the zone: generates the keys that
+// are missing, schedules the successors of keys that reached the end of
+// their lifetime, and drops the keys that have been removed.
+// Returns whether the keys changed.
+func (d *DNSSEC) roll(zone string, keys *stored_keys, now time.Time, max_ttl uint32) (bool, error) {
+	changed := false
+	remaining := []stored_key{}
+	for _, stored := range keys.Keys {
+		if !stored.Removed.IsZero() && !now.Before(stored.Removed) {
+			changed = true
+			continue
+		}
+		if stored.Published.IsZero() || stored.Active.IsZero() {
+			// keys from before rollovers were supported
+			stored.Published, stored.Active, stored.Submitted =
+				stored.Created, stored.Created, stored.Created
+			changed = true
+		}
+		remaining = append(remaining, stored)
+	}
+	keys.Keys = remaining
+
+	// time for a new DNSKEY record to reach all resolvers
+	publish_delay := time.Duration(d.TTL)*time.Second + time.Duration(d.PropagationDelay)
+
+	for _, flags := range []uint16{257, 256} {
+		// the key that was activated last
+		var current *stored_key
+		for i := range keys.Keys {
+			stored := &keys.Keys[i]
+			key, err := d.parse_key(*stored)
+			if err != nil {
+				return false, err
+			}
+			if key.dnskey.Flags != flags || key.dnskey.Algorithm != d.algorithm {
+				continue
+			}
+			if current == nil || stored.Active.After(current.Active) {
+				current = stored
+			}
+		}
+
+		if current == nil {
+			stored, err := d.generate_key(zone, flags, now)
+			if err != nil {
+				return false, err
+			}
+			stored.Published, stored.Active, stored.Submitted = now, now, now
+			keys.Keys = append(keys.Keys, stored)
+			changed = true
+			continue
+		}
+
+		if flags == 256 && d.ZSKLifetime > 0 {
+			// pre-publish rollover: the successor is published first, and
+			// only used once its DNSKEY record has reached all resolvers
+			rollover := current.Active.Add(time.Duration(d.ZSKLifetime) - publish_delay)
+			if now.Before(rollover) {
+				continue
+			}
+			successor, err := d.generate_key(zone, flags, now)
+			if err != nil {
+				return false, err
+			}
+			successor.Published = now
+			successor.Active = now.Add(publish_delay)
+			// signatures made with the key may be cached for the largest TTL
+			current.Retired = successor.Active
+			current.Removed = current.Retired.
+				Add(time.Duration(max_ttl)*time.Second + time.Duration(d.PropagationDelay))
+			keys.Keys = append(keys.Keys, successor)
+			changed = true
+		}
+
+		if flags == 257 && d.KSKLifetime > 0 {
+			// double signature rollover: the successor signs the DNSKEY
+			// RRset right away, and is submitted to the parent once its
+			// DNSKEY record has reached all resolvers
+			if now.Before(current.Active.Add(time.Duration(d.KSKLifetime))) {
+				continue
+			}
+			successor, err := d.generate_key(zone, flags, now)
+			if err != nil {
+				return false, err
+			}
+			successor.Published, successor.Active = now, now
+			successor.Submitted = now.Add(publish_delay)
+			// the DS record of the key may be cached until the parent has
+			// replaced it, and its TTL has expired
+			current.Retired = successor.Submitted.
+				Add(time.Duration(d.ParentDelay) + time.Duration(d.DSTTL))
+			current.Removed = current.Retired
+			keys.Keys = append(keys.Keys, successor)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// The next time the state of the keys changes
+func (d *DNSSEC) next_event(keys *stored_keys, now time.Time) time.Time {
+	next := time.Time{}
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	for _, stored := range keys.Keys {
+		consider(stored.Published)
+		consider(stored.Active)
+		consider(stored.Retired)
+		consider(stored.Removed)
+		consider(stored.Submitted)
+		if d.ZSKLifetime > 0 {
+			consider(stored.Active.Add(time.Duration(d.ZSKLifetime)))
+		}
+		if d.KSKLifetime > 0 {
+			consider(stored.Active.Add(time.Duration(d.KSKLifetime)))
+		}
+	}
+	return next
+}
+
+// Loads the keys of the zone from storage, and advances their rollovers
+func (d *DNSSEC) load_keys(
+	ctx context.Context,
+	storage certmagic.Storage,
+	zone string,
+	now time.Time,
+	max_ttl uint32,
+) (*stored_keys, error) {
+	storage_key := dnssec_storage_key(zone)
+	// other instances sharing the storage must not generate different keys
+	err := storage.Lock(ctx, storage_key)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Unlock(ctx, storage_key)
+
+	keys := &stored_keys{}
+	data, err := storage.Load(ctx, storage_key)
+	if err == nil {
+		err = json.Unmarshal(data, keys)
+		if err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	changed, err := d.roll(zone, keys, now, max_ttl)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		data, err := json.Marshal(keys)
+		if err != nil {
+			return nil, err
+		}
+		err = storage.Store(ctx, storage_key, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// Switches the signer to the keys that are in use at the given time, and
+// determines the DNSKEY, CDS & CDNSKEY records to publish.
+func (d *DNSSEC) use_keys(signer *zone_signer, keys *stored_keys, now time.Time) ([]dns.RR, error) {
+	ksks := []*signing_key{}
+	var zsk *signing_key
+	var zsk_active time.Time
+	var submitted *signing_key
+	var submitted_since time.Time
+
+	records := []dns.RR{}
+	for i := range keys.Keys {
+		stored := &keys.Keys[i]
+		key, err := d.parse_key(*stored)
+		if err != nil {
+			return nil, err
+		}
+		if key.dnskey.Algorithm != d.algorithm || !stored.is_published(now) {
+			continue
+		}
+		records = append(records, key.dnskey)
+		if !stored.is_active(now) {
+			continue
+		}
+		if key.dnskey.Flags == 257 {
+			ksks = append(ksks, key)
+			if !stored.Submitted.After(now) &&
+				(submitted == nil || stored.Submitted.After(submitted_since)) {
+				submitted, submitted_since = key, stored.Submitted
+			}
+		} else if zsk == nil || stored.Active.After(zsk_active) {
+			zsk, zsk_active = key, stored.Active
+		}
+	}
+	if len(ksks) == 0 || zsk == nil {
+		return nil, fmt.Errorf("no active keys for zone '%s'", signer.zone)
+	}
+
+	if submitted != nil {
+		ds := submitted.dnskey.ToDS(dns.SHA256)
+		cds := &dns.CDS{DS: *ds}
+		cds.Hdr.Rrtype = dns.TypeCDS
+		cdnskey := &dns.CDNSKEY{DNSKEY: *submitted.dnskey}
+		cdnskey.Hdr.Rrtype = dns.TypeCDNSKEY
+		records = append(records, cds, cdnskey)
+		signer.ds = ds.String()
+	}
+
+	signer.mu.Lock()
+	defer signer.mu.Unlock()
+	if !same_keys(signer.ksks, ksks) || !same_keys([]*signing_key{signer.zsk}, []*signing_key{zsk}) {
+		// signatures made with other keys must not be reused
+		signer.cache = map[key]*cached_signature{}
+	}
+	signer.ksks = ksks
+	signer.zsk = zsk
+	return records, nil
+}
+
+func same_keys(a []*signing_key, b []*signing_key) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil || a[i].dnskey.String() != b[i].dnskey.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// Sets up the signers of the zones, loading (or generating) their keys
+func (d *DNSSEC) signers(
+	ctx context.Context,
+	storage certmagic.Storage,
+	logger *zap.Logger,
+	zones []string,
+) (map[string]*zone_signer, error) {
+	if len(d.Zones) > 0 {
+		zones = d.Zones
+	}
+	now := time.Now()
+	signers := map[string]*zone_signer{}
+	for _, zone := range zones {
+		signer := &zone_signer{
+			zone:     zone,
+			validity: time.Duration(d.Validity),
+			mu:       new(sync.Mutex),
+			max_ttl:  d.TTL,
+		}
+		keys, err := d.load_keys(ctx, storage, zone, now, signer.max_ttl)
+		if err != nil {
+			return nil, err
+		}
+		signer.published, err = d.use_keys(signer, keys, now)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(
+			"signing zone, publish the DS record at the parent zone",
+			zap.String("zone", zone),
+			zap.String("ds", signer.ds),
+		)
+		signers[zone] = signer
+	}
+	return signers, nil
+}
+
+// Keeps the keys of the zones up-to-date until the app is stopped
+func (d *DNSSEC) run(a *App, signers map[string]*zone_signer) {
+	logger := a.logger.Named("dnssec")
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-a.shutdown:
+			return
+		}
+
+		now := time.Now()
+		// check at least hourly, in case another instance changed the keys
+		next := now.Add(time.Hour)
+		for zone, signer := range signers {
+			signer.mu.Lock()
+			max_ttl := signer.max_ttl
+			signer.mu.Unlock()
+
+			keys, err := d.load_keys(a.ctx, a.ctx.Storage(), zone, now, max_ttl)
+			if err != nil {
+				logger.Error("failed to load keys", zap.String("zone", zone), zap.Error(err))
+				continue
+			}
+			if event := d.next_event(keys, now); !event.IsZero() && event.Before(next) {
+				next = event
+			}
+			previous_ds := signer.ds
+			records, err := d.use_keys(signer, keys, now)
+			if err != nil {
+				logger.Error("failed to use keys", zap.String("zone", zone), zap.Error(err))
+				continue
+			}
+			if same_records(signer.published, records) {
+				continue
+			}
+			err = a.replace(signer.published, records)
+			if err != nil {
+				logger.Error("failed to publish keys", zap.String("zone", zone), zap.Error(err))
+				continue
+			}
+			signer.published = records
+			logger.Info("keys changed", zap.String("zone", zone), zap.Int("key_count", len(keys.Keys)))
+			if signer.ds != previous_ds {
+				logger.Info(
+					"key signing key changed, the DS record at the parent zone has to be updated",
+					zap.String("zone", zone),
+					zap.String("ds", signer.ds),
+				)
+			}
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// Signs the RRset without caching the signatures. Expects mu to be held.
+func (z *zone_signer) sign_uncached(rrset []dns.RR) ([]dns.RR, error) {
+	keys := []*signing_key{z.zsk}
+	switch rrset[0].Header().Rrtype {
+	case dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY:
+		keys = z.ksks
+	}
+	rrsigs := []dns.RR{}
+	for _, key := range keys {
+		rrsig, err := z.sign_with(key, rrset)
+		if err != nil {
+			return nil, err
+		}
+		rrsigs = append(rrsigs, rrsig)
+	}
+	return rrsigs, nil
+}
+
+func (z *zone_signer) sign_with(key *signing_key, rrset []dns.RR) (*dns.RRSIG, error) {
+	now := time.Now()
+	rrsig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   rrset[0].Header().Name,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    rrset[0].Header().Ttl,
+		},
+		Algorithm: key.dnskey.Algorithm,
+		// allow for clocks that are a little behind
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(z.validity).Unix()),
+		KeyTag:     key.dnskey.KeyTag(),
+		SignerName: z.zone,
+	}
+	err := rrsig.Sign(key.signer, rrset)
+	if err != nil {
+		return nil, err
+	}
+	return rrsig, nil
+}
+
+// Signs the RRset, reusing previous signatures if the RRset hasn't changed
+// and the signatures are still valid for at least half of the validity
+// period.
+func (z *zone_signer) sign(rrset []dns.RR) ([]dns.RR, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	k := rr_key(rrset[0])
+	// the order of the records doesn't change the signature
+	lines := []string{}
+	for _, rr := range rrset {
+		lines = append(lines, rr.String()+"\n")
+		if rr.Header().Ttl > z.max_ttl {
+			z.max_ttl = rr.Header().Ttl
+		}
+	}
+	sort.Strings(lines)
+	content := strings.Join(lines, "")
+	cached, exists := z.cache[k]
+	if exists && cached.content == content {
+		expiration := time.Unix(int64(cached.rrsigs[0].(*dns.RRSIG).Expiration), 0)
+		if time.Until(expiration) > z.validity/2 {
+			return cached.rrsigs, nil
+		}
+	}
+	rrsigs, err := z.sign_uncached(rrset)
+	if err != nil {
+		return nil, err
+	}
+	z.cache[k] = &cached_signature{content, rrsigs}
+	return rrsigs, nil
+}
+
+// Signs a synthesized RRset, whose signatures are not worth caching
+func (z *zone_signer) sign_synthesized(rrset []dns.RR) ([]dns.RR, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.sign_uncached(rrset)
+}
+
+// Whether the query has the DNSSEC OK bit set
+func dnssec_ok(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// Appends the RRset & its signature to the section
+func (z *zone_signer) append_signed(section []dns.RR, rrset []dns.RR) ([]dns.RR, error) {
+	rrsigs, err := z.sign(rrset)
+	if err != nil {
+		return nil, err
+	}
+	section = append(section, rrset...)
+	return append(section, rrsigs...), nil
+}
+
+// Proves that there are no records of the queried type for the name, with a
+// minimally covering NSEC record: the name is claimed to exist, with none but
+// the types that actually exist. This avoids revealing the other names in
+// the zone, and doesn't require signing in advance.
+func (srv *Server) deny_existence(m *dns.Msg, signer *zone_signer, name string) error {
+	name = strings.ToLower(name)
+	m.Ns = []dns.RR{}
+	if soa, ok := srv.soa(signer.zone); ok {
+		ns, err := signer.append_signed(m.Ns, []dns.RR{soa})
+		if err != nil {
+			return err
+		}
+		m.Ns = ns
+	}
+	nsec, err := srv.synthesize_nsec(signer, name)
+	if err != nil {
+		return err
+	}
+	m.Ns = append(m.Ns, nsec...)
+	m.Rcode = dns.RcodeSuccess
+	return nil
+}
+
+// Synthesizes a signed NSEC record for the name that only covers the name
+// itself, listing the types it has, which are the types of the wildcard for
+// names answered from one. Its TTL is the negative caching TTL of the zone.
+func (srv *Server) synthesize_nsec(signer *zone_signer, name string) ([]dns.RR, error) {
+	ttl := uint32(3600)
+	if soa, ok := srv.soa(signer.zone); ok {
+		ttl = soa.Minttl
+		if soa.Hdr.Ttl < ttl {
+			ttl = soa.Hdr.Ttl
+		}
+	}
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	for k := range srv.Records {
+		if k.Name == name {
+			types = append(types, uint16(k.Type))
+		}
+	}
+	if !srv.name_in_use(name) {
+		if synthesized, matched := srv.synthesized_records(name); matched {
+			seen := map[uint16]bool{}
+			for _, record := range synthesized {
+				if rrtype := record.Header().Rrtype; !seen[rrtype] {
+					seen[rrtype] = true
+					types = append(types, rrtype)
+				}
+			}
+		} else if wildcard, exists := srv.wildcard_of(name, signer.zone); exists {
+			for k := range srv.Records {
+				if k.Name == wildcard {
+					types = append(types, uint16(k.Type))
+				}
+			}
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	nsec := &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		NextDomain: "\\000." + name,
+		TypeBitMap: types,
+	}
+	rrsigs, err := signer.sign_synthesized([]dns.RR{nsec})
+	if err != nil {
+		return nil, err
+	}
+	return append([]dns.RR{nsec}, rrsigs...), nil
+}
+
+// Parses the block of the "dnssec" subdirective
+func (d *DNSSEC) unmarshal_caddyfile(disp *caddyfile.Dispenser) error {
+	for nesting := disp.Nesting(); disp.NextBlock(nesting); {
+		switch disp.Val() {
+		case "zone":
+			values := disp.RemainingArgs()
+			if len(values) == 0 {
+				return disp.ArgErr()
+			}
+			d.Zones = append(d.Zones, values...)
+		case "algorithm":
+			if !disp.NextArg() {
+				return disp.ArgErr()
+			}
+			d.Algorithm = disp.Val()
+			if disp.NextArg() {
+				return disp.ArgErr()
+			}
+		case "validity", "zsk_lifetime", "ksk_lifetime", "propagation_delay", "parent_delay", "ds_ttl":
+			option := disp.Val()
+			if !disp.NextArg() {
+				return disp.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(disp.Val())
+			if err != nil {
+				return disp.WrapErr(err)
+			}
+			switch option {
+			case "validity":
+				d.Validity = caddy.Duration(duration)
+			case "zsk_lifetime":
+				d.ZSKLifetime = caddy.Duration(duration)
+			case "ksk_lifetime":
+				d.KSKLifetime = caddy.Duration(duration)
+			case "propagation_delay":
+				d.PropagationDelay = caddy.Duration(duration)
+			case "parent_delay":
+				d.ParentDelay = caddy.Duration(duration)
+			case "ds_ttl":
+				d.DSTTL = caddy.Duration(duration)
+			}
+			if disp.NextArg() {
+				return disp.ArgErr()
+			}
+		case "ttl":
+			if !disp.NextArg() {
+				return disp.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(disp.Val(), 10, 32)
+			if err != nil {
+				return disp.WrapErr(err)
+			}
+			d.TTL = uint32(ttl)
+			if disp.NextArg() {
+				return disp.ArgErr()
+			}
+		default:
+			return disp.Errf("unrecognized DNSSEC subdirective '%s'", disp.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+package stub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// HTTP handler implementing the DynDNS2 update protocol
+// (/nic/update?hostname=<hostname>&myip=<ip>), which updates the A & AAAA
+// records served by the "dns" app.
+//
+// The records are persisted in storage, so they survive restarts.
+type DynDNS struct {
+	// The users that may update records
+	Users []DynDNSUser `json:"users,omitempty"`
+
+	// The TTL of the records, in seconds. Defaults to 60.
+	TTL uint32 `json:"ttl,omitempty"`
+
+	ctx         caddy.Context     // set in Provision()
+	logger      *zap.Logger       // set in Provision()
+	storage     certmagic.Storage // set in Provision()
+	app_channel chan request      // set in Provision()
+	records     *dyndns_records   // set in Provision(), shared with the app
+}
+
+// The records of the DynDNS handlers of an app. All handlers share them,
+// so that the stored records are only loaded & published once.
+type dyndns_records struct {
+	mu      sync.Mutex
+	loaded  bool                // protected by mu
+	current map[string][]dns.RR // by hostname, protected by mu
+}
+
+// A user of the DynDNS handler
+type DynDNSUser struct {
+	Username string `json:"username"`
+
+	// The base64-encoded bcrypt hash of the password,
+	// as generated by `caddy hash-password`
+	Password string `json:"password"`
+
+	// The hostnames the user may update. A leading "*." allows all
+	// subdomains of a name.
+	Hostnames []string `json:"hostnames,omitempty"`
+}
+
+func (u *DynDNSUser) may_update(hostname string) bool {
+	for _, allowed := range u.Hostnames {
+		if matches_name(allowed, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the name matches the pattern, which is either a name, or a name
+// with a leading "*." that matches all of its subdomains.
+func matches_name(pattern string, name string) bool {
+	pattern = dns.CanonicalName(pattern)
+	name = dns.CanonicalName(name)
+	if pattern == name {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") &&
+		dns.IsSubDomain(pattern[2:], name) &&
+		name != pattern[2:]
+}
+
+// CaddyModule returns the Caddy module information.
+func (DynDNS) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.dyndns",
+		New: func() caddy.Module { return new(DynDNS) },
+	}
+}
+
+const dyndns_storage_prefix = "dns/dyndns"
+
+// Provision sets up the module. Implements caddy.Provisioner.
+func (h *DynDNS) Provision(ctx caddy.Context) error {
+	h.ctx = ctx
+	h.logger = ctx.Logger()
+	h.storage = ctx.Storage()
+	if h.TTL == 0 {
+		h.TTL = 60
+	}
+	app, err := ctx.App("dns")
+	if err != nil {
+		return err
+	}
+	dns_app, ok := app.(*App)
+	if !ok {
+		return fmt.Errorf("received invalid app")
+	}
+	h.app_channel = dns_app.requests
+	h.records = dns_app.dyndns
+
+	// the app publishes the stored records when it starts
+	h.records.mu.Lock()
+	defer h.records.mu.Unlock()
+	if h.records.loaded {
+		return nil
+	}
+	h.records.current, err = h.load()
+	if err != nil {
+		return err
+	}
+	h.records.loaded = true
+	return nil
+}
+
+// Loads the stored records of all hostnames
+func (h *DynDNS) load() (map[string][]dns.RR, error) {
+	current := map[string][]dns.RR{}
+	keys, err := h.storage.List(h.ctx, dyndns_storage_prefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return current, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		data, err := h.storage.Load(h.ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		var values []string
+		err = json.Unmarshal(data, &values)
+		if err != nil {
+			return nil, err
+		}
+		records := []dns.RR{}
+		for _, s := range values {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, rr)
+		}
+		if len(records) > 0 {
+			current[records[0].Header().Name] = records
+		}
+	}
+	return current, nil
+}
+
+func (h *DynDNS) save(hostname string, records []dns.RR) error {
+	values := []string{}
+	for _, record := range records {
+		values = append(values, record.String())
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	key := path.Join(dyndns_storage_prefix, certmagic.StorageKeys.Safe(hostname))
+	return h.storage.Store(h.ctx, key, data)
+}
+
+// Replaces previous with records in the app
+func (h *DynDNS) publish(previous []dns.RR, records []dns.RR) error {
+	resp := make(chan error)
+	req := request{
+		append:    true,
+		records:   records,
+		replaces:  previous,
+		responder: resp,
+	}
+	select {
+	case h.app_channel <- req:
+	case <-h.ctx.Done():
+		return h.ctx.Err()
+	}
+	return <-resp
+}
+
+// Looks up the user, and checks the password.
+func (h *DynDNS) authenticate(r *http.Request) (*DynDNSUser, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	hash := caddyauth.BcryptHash{}
+	for i := range h.Users {
+		user := &h.Users[i]
+		if user.Username != username {
+			continue
+		}
+		hashed, err := base64.StdEncoding.DecodeString(user.Password)
+		if err != nil {
+			return nil, false
+		}
+		same, err := hash.Compare(hashed, []byte(password), nil)
+		return user, same && err == nil
+	}
+	// compare anyway, to avoid leaking which users exist through timing
+	_, _ = hash.Compare(hash.FakeHash(), []byte(password), nil)
+	return nil, false
+}
+
+// The addresses to update to: from the "myip" (and "myipv6") parameters,
+// or else the address of the client.
+func update_addresses(r *http.Request) ([]net.IP, error) {
+	values := []string{}
+	for _, param := range []string{"myip", "myipv6"} {
+		if value := r.URL.Query().Get(param); value != "" {
+			values = append(values, strings.Split(value, ",")...)
+		}
+	}
+	if len(values) == 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		values = []string{host}
+	}
+	ips := []net.IP{}
+	for _, value := range values {
+		ip := net.ParseIP(strings.TrimSpace(value))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address '%s'", value)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Updates the records of a hostname, returning the DynDNS2 response code
+func (h *DynDNS) update(hostname string, ips []net.IP) (string, error) {
+	h.records.mu.Lock()
+	defer h.records.mu.Unlock()
+
+	previous := h.records.current[hostname]
+	records := []dns.RR{}
+	has_v4, has_v6 := false, false
+	for _, ip := range ips {
+		records = append(records, address_record(hostname, ip, h.TTL))
+		if ip.To4() != nil {
+			has_v4 = true
+		} else {
+			has_v6 = true
+		}
+	}
+	// only replace the address family that was updated
+	for _, record := range previous {
+		switch record.Header().Rrtype {
+		case dns.TypeA:
+			if !has_v4 {
+				records = append(records, record)
+			}
+		case dns.TypeAAAA:
+			if !has_v6 {
+				records = append(records, record)
+			}
+		}
+	}
+
+	if same_records(previous, records) {
+		return "nochg", nil
+	}
+	err := h.publish(previous, records)
+	if err != nil {
+		return "911", err
+	}
+	h.records.current[hostname] = records
+	err = h.save(hostname, records)
+	if err != nil {
+		return "911", err
+	}
+	return "good", nil
+}
+
+func same_records(a []dns.RR, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	in_a := map[string]bool{}
+	for _, record := range a {
+		in_a[record.String()] = true
+	}
+	for _, record := range b {
+		if !in_a[record.String()] {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (h *DynDNS) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	user, ok := h.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dyndns"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, err := w.Write([]byte("badauth\n"))
+		return err
+	}
+
+	hostnames := r.URL.Query().Get("hostname")
+	if hostnames == "" {
+		_, err := w.Write([]byte("notfqdn\n"))
+		return err
+	}
+	ips, err := update_addresses(r)
+	if err != nil {
+		h.logger.Debug("invalid update", zap.Error(err))
+		_, err := w.Write([]byte("911\n"))
+		return err
+	}
+
+	addresses := []string{}
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	response := ""
+	for _, hostname := range strings.Split(hostnames, ",") {
+		hostname = strings.TrimSpace(hostname)
+		if _, ok := dns.IsDomainName(hostname); !ok || !strings.Contains(hostname, ".") {
+			response += "notfqdn\n"
+			continue
+		}
+		hostname = dns.CanonicalName(hostname)
+		if !user.may_update(hostname) {
+			response += "nohost\n"
+			continue
+		}
+		code, err := h.update(hostname, ips)
+		if err != nil {
+			h.logger.Error(
+				"update failed",
+				zap.String("hostname", hostname),
+				zap.Error(err),
+			)
+		} else {
+			h.logger.Info(
+				"updated",
+				zap.String("user", user.Username),
+				zap.String("hostname", hostname),
+				zap.Strings("addresses", addresses),
+				zap.String("result", code),
+			)
+		}
+		if code == "911" {
+			response += code + "\n"
+		} else {
+			response += code + " " + strings.Join(addresses, ",") + "\n"
+		}
+	}
+	_, err = w.Write([]byte(response))
+	return err
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	dyndns {
+//	    user <username> <hashed_password_base64> <hostname...>
+//	    [ttl <seconds>]
+//	}
+func (h *DynDNS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "user":
+				args := d.RemainingArgs()
+				if len(args) < 3 {
+					return d.ArgErr()
+				}
+				h.Users = append(h.Users, DynDNSUser{
+					Username:  args[0],
+					Password:  args[1],
+					Hostnames: args[2:],
+				})
+			case "ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := strconv.ParseUint(d.Val(), 10, 32)
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				h.TTL = uint32(ttl)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func parseDynDNS(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var handler DynDNS
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return &handler, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*DynDNS)(nil)
+	_ caddyhttp.MiddlewareHandler = (*DynDNS)(nil)
+	_ caddyfile.Unmarshaler       = (*DynDNS)(nil)
+)
@@ -0,0 +1,140 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Policies for the EDNS Client Subnet (RFC 7871) of queries
+const (
+	// Select GeoIP records by the client subnet of queries from trusted
+	// resolvers, and tell them for which subnets the answer is valid (the
+	// default)
+	subnet_use = "use"
+
+	// Select GeoIP records by the address of the client
+	subnet_ignore = "ignore"
+
+	// Like "ignore", but also remove the client subnet from forwarded
+	// queries
+	subnet_strip = "strip"
+)
+
+func valid_subnet_policy(policy string) error {
+	switch policy {
+	case "", subnet_use, subnet_ignore, subnet_strip:
+		return nil
+	}
+	return fmt.Errorf("unknown client subnet policy '%s'", policy)
+}
+
+// The client subnet option of the query, if it has one, the policy allows
+// using it and the query comes from a trusted resolver. Anyone else could
+// claim to be in any network. Returns false if the option is invalid
+// (RFC 7871 section 7.1.2).
+func (srv *Server) client_subnet(q query) (*dns.EDNS0_SUBNET, bool) {
+	if srv.ClientSubnet == subnet_ignore || srv.ClientSubnet == subnet_strip {
+		return nil, true
+	}
+	if !networks_contain(srv.trusted_resolvers, address_ip(q.w.RemoteAddr())) {
+		return nil, true
+	}
+	opt := q.r.IsEdns0()
+	if opt == nil {
+		return nil, true
+	}
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		if subnet.Family == 0 && subnet.SourceNetmask == 0 {
+			// sent by dig, no information about the client
+			return nil, true
+		}
+		bits := 32
+		if subnet.Family == 2 {
+			bits = 128
+		} else if subnet.Family != 1 {
+			return nil, false
+		}
+		if int(subnet.SourceNetmask) > bits || subnet.SourceScope != 0 {
+			return nil, false
+		}
+		// the address must not have bits set beyond the prefix
+		mask := net.CIDRMask(int(subnet.SourceNetmask), bits)
+		address := subnet.Address.To16()
+		if bits == 32 {
+			address = subnet.Address.To4()
+		}
+		if address == nil || !address.Mask(mask).Equal(address) {
+			return nil, false
+		}
+		return subnet, true
+	}
+	return nil, true
+}
+
+// The address the answer is selected by: the one of the client subnet,
+// unless the resolver didn't reveal any part of it
+func client_ip(q query, subnet *dns.EDNS0_SUBNET) net.IP {
+	if subnet != nil && subnet.SourceNetmask > 0 {
+		return subnet.Address
+	}
+	return address_ip(q.w.RemoteAddr())
+}
+
+// Whether clients in other networks could receive a different answer,
+// i.e. whether a GeoIP record exists for a name of the answer. Views are
+// selected by the address of the resolver, so its clients share them.
+func (srv *Server) address_dependent(m *dns.Msg) bool {
+	names := map[string]bool{strings.ToLower(m.Question[0].Name): true}
+	for _, rr := range m.Answer {
+		names[strings.ToLower(rr.Header().Name)] = true
+		if cname, ok := rr.(*dns.CNAME); ok {
+			names[strings.ToLower(cname.Target)] = true
+		}
+	}
+	if srv.GeoIP != nil {
+		for k := range srv.GeoIP.overrides {
+			if names[k.Name] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Adds the client subnet to the response, with the prefix length the
+// answer is valid for: the whole subnet if it depends on the address of the
+// client, and all addresses otherwise (RFC 7871 section 7.2.1)
+func (srv *Server) echo_subnet(m *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+	opt := m.IsEdns0()
+	if subnet == nil || opt == nil {
+		return
+	}
+	echo := *subnet
+	echo.SourceScope = 0
+	if srv.address_dependent(m) {
+		echo.SourceScope = subnet.SourceNetmask
+	}
+	opt.Option = append(opt.Option, &echo)
+}
+
+// Removes the client subnet from the query
+func remove_subnet(r *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := []dns.EDNS0{}
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,161 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Forwards queries for names the server doesn't hold to a backend DNS
+// server, e.g. an existing authoritative server moved to another port. The
+// queries are forwarded over the same protocol (UDP or TCP) they came in on.
+type Forward struct {
+	// The addresses of the backend servers, tried in turn. Defaults to
+	// port 53.
+	Upstreams []string `json:"upstreams"`
+
+	// How long to wait for a response from a backend. Defaults to 2 seconds.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// How often to send a query before giving up. Every attempt goes to the
+	// next backend. Defaults to 3.
+	Attempts int `json:"attempts,omitempty"`
+
+	logger *zap.Logger // set in provision()
+}
+
+func (f *Forward) provision(logger *zap.Logger) error {
+	if len(f.Upstreams) == 0 {
+		return fmt.Errorf("forwarding requires an upstream")
+	}
+	for i, addr := range f.Upstreams {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			f.Upstreams[i] = net.JoinHostPort(addr, "53")
+		}
+	}
+	if f.Timeout == 0 {
+		f.Timeout = caddy.Duration(2 * time.Second)
+	}
+	if f.Attempts == 0 {
+		f.Attempts = 3
+	}
+	if f.Attempts < 0 {
+		return fmt.Errorf("invalid number of attempts: %d", f.Attempts)
+	}
+	f.logger = logger.Named("forward")
+	return nil
+}
+
+// Sends the query to the backends until one of them responds
+func (f *Forward) exchange(r *dns.Msg, network string) (*dns.Msg, error) {
+	c := &dns.Client{
+		Net:     network,
+		Timeout: time.Duration(f.Timeout),
+	}
+	var err error
+	for attempt := 0; attempt < f.Attempts; attempt++ {
+		upstream := f.Upstreams[attempt%len(f.Upstreams)]
+		var response *dns.Msg
+		response, _, err = c.Exchange(r, upstream)
+		if err == nil {
+			return response, nil
+		}
+		f.logger.Debug(
+			"upstream failed",
+			zap.String("upstream", upstream),
+			zap.Int("attempt", attempt+1),
+			zap.Error(err),
+		)
+	}
+	return nil, err
+}
+
+// Answers the query with the response of a backend, or SERVFAIL if none
+// responds. Runs outside of the main loop, so that slow backends don't hold
+// up other queries. The client subnet is removed from the forwarded query
+// if strip_subnet is set.
+func (f *Forward) forward(q query, strip_subnet bool) {
+	network := "udp"
+	if q.w.RemoteAddr().Network() == "tcp" {
+		network = "tcp"
+	}
+	r := q.r.Copy()
+	if strip_subnet {
+		remove_subnet(r)
+	}
+	// TSIG is between the client and this server
+	if r.IsTsig() != nil {
+		r.Extra = r.Extra[:len(r.Extra)-1]
+	}
+	response, err := f.exchange(r, network)
+	if err != nil {
+		f.logger.Warn(
+			"forwarding failed",
+			zap.Stringer("address", q.w.RemoteAddr()),
+			zap.Error(err),
+		)
+		response = new(dns.Msg)
+		response.SetRcode(q.r, dns.RcodeServerFailure)
+	}
+	response.Id = q.r.Id
+	f.logger.Debug(
+		"forwarded query",
+		zap.Stringer("address", q.w.RemoteAddr()),
+		zap.Object("response", LoggableDNSMsg{response}),
+	)
+	write_response(q, response)
+}
+
+// Parses a "forward" subdirective. Syntax:
+//
+//	forward [<upstream...>] {
+//	    [upstream <address...>]
+//	    [timeout <duration>]
+//	    [attempts <count>]
+//	}
+func (f *Forward) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	f.Upstreams = append(f.Upstreams, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "upstream":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return d.ArgErr()
+			}
+			f.Upstreams = append(f.Upstreams, values...)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			f.Timeout = caddy.Duration(timeout)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "attempts":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			attempts, err := strconv.Atoi(d.Val())
+			if err != nil || attempts < 1 {
+				return d.Errf("invalid number of attempts '%s'", d.Val())
+			}
+			f.Attempts = attempts
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized forward subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
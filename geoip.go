@@ -0,0 +1,233 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+// Records that are only served to clients in some countries or continents,
+// e.g. the addresses of the closest server. The location of the client is
+// looked up in a MaxMind database (.mmdb), by the EDNS Client Subnet of the
+// query if it has one (and its use is allowed), and by the address of the
+// client otherwise.
+type GeoIP struct {
+	// The path of the database, e.g. GeoLite2-Country.mmdb
+	Database string `json:"database"`
+
+	// The records with their locations
+	Records []GeoRecord `json:"records,omitempty"`
+
+	reader    *maxminddb.Reader            // set in provision()
+	overrides map[key][]GeoRecord          // set in provision()
+	merged    map[geo_key]map[key][]dns.RR // owned by Server.main(), reset on changes
+}
+
+// A record that replaces the records of the same name & type for clients
+// in the countries or continents. Records for a country take precedence
+// over records for a continent.
+type GeoRecord struct {
+	// The record. Placeholders are expanded when the app is provisioned.
+	Record string `json:"record"`
+
+	// ISO 3166 country codes, like "DE"
+	Countries []string `json:"countries,omitempty"`
+
+	// Continent codes, like "EU"
+	Continents []string `json:"continents,omitempty"`
+
+	rr dns.RR // set in provision()
+}
+
+// The location of a client
+type location struct {
+	country   string
+	continent string
+}
+
+// The merged records are cached per view & location
+type geo_key struct {
+	view     *View
+	location location
+}
+
+func (g *GeoIP) provision() error {
+	if g.Database == "" {
+		return fmt.Errorf("GeoIP requires a database")
+	}
+	// the database is read into memory, so there's nothing to close
+	content, err := os.ReadFile(g.Database)
+	if err != nil {
+		return err
+	}
+	g.reader, err = maxminddb.FromBytes(content)
+	if err != nil {
+		return fmt.Errorf("invalid GeoIP database '%s': %v", g.Database, err)
+	}
+	g.overrides = map[key][]GeoRecord{}
+	for i := range g.Records {
+		record := &g.Records[i]
+		if len(record.Countries) == 0 && len(record.Continents) == 0 {
+			return fmt.Errorf("GeoIP record '%s' requires a location", record.Record)
+		}
+		record.rr, err = expand_record(record.Record)
+		if err != nil || record.rr == nil {
+			return fmt.Errorf("invalid record '%s': %v", record.Record, err)
+		}
+		k := rr_key(record.rr)
+		g.overrides[k] = append(g.overrides[k], *record)
+	}
+	return nil
+}
+
+// Looks up the location of the address
+func (g *GeoIP) locate(ip net.IP) (location, error) {
+	var result struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		Continent struct {
+			Code string `maxminddb:"code"`
+		} `maxminddb:"continent"`
+	}
+	if ip == nil {
+		return location{}, nil
+	}
+	err := g.reader.Lookup(ip, &result)
+	if err != nil {
+		return location{}, err
+	}
+	return location{
+		country:   strings.ToUpper(result.Country.ISOCode),
+		continent: strings.ToUpper(result.Continent.Code),
+	}, nil
+}
+
+// Whether any of the codes is the one of the location
+func has_code(codes []string, code string) bool {
+	for _, c := range codes {
+		if code != "" && strings.EqualFold(c, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// The records served at the location: the records of the server (or the
+// view), with the RRsets of the location replacing those of the same name
+// & type
+func (g *GeoIP) records(global map[key][]dns.RR, k geo_key) map[key][]dns.RR {
+	if merged, ok := g.merged[k]; ok {
+		return merged
+	}
+	selected := map[key][]dns.RR{}
+	for rr_key, records := range g.overrides {
+		countries, continents := []dns.RR{}, []dns.RR{}
+		for _, record := range records {
+			if has_code(record.Countries, k.location.country) {
+				countries = append(countries, record.rr)
+			} else if has_code(record.Continents, k.location.continent) {
+				continents = append(continents, record.rr)
+			}
+		}
+		if len(countries) > 0 {
+			selected[rr_key] = countries
+		} else if len(continents) > 0 {
+			selected[rr_key] = continents
+		}
+	}
+	merged := global
+	if len(selected) > 0 {
+		merged = make(map[key][]dns.RR, len(global)+len(selected))
+		for rr_key, rrset := range global {
+			merged[rr_key] = rrset
+		}
+		for rr_key, rrset := range selected {
+			merged[rr_key] = rrset
+		}
+	}
+	if g.merged == nil {
+		g.merged = map[geo_key]map[key][]dns.RR{}
+	}
+	g.merged[k] = merged
+	return merged
+}
+
+// Serves the records of the client's location (within its view) while
+// handling the query. Returns a function that restores the records of the
+// server.
+func (srv *Server) enter_location(client net.IP, view *View) func() {
+	if srv.GeoIP == nil {
+		return func() {}
+	}
+	loc, err := srv.GeoIP.locate(client)
+	if err != nil {
+		srv.logger.Warn("GeoIP lookup failed", zap.Stringer("client", client), zap.Error(err))
+		return func() {}
+	}
+	srv.logger.Debug(
+		"located client",
+		zap.Stringer("client", client),
+		zap.String("country", loc.country),
+		zap.String("continent", loc.continent),
+	)
+	global := srv.Records
+	srv.Records = srv.GeoIP.records(global, geo_key{view, loc})
+	return func() { srv.Records = global }
+}
+
+// Parses a "geoip" subdirective. Syntax:
+//
+//	geoip <database> {
+//	    [record "<record>" {
+//	        [country <code...>]
+//	        [continent <code...>]
+//	    }]
+//	}
+func (g *GeoIP) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	g.Database = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "record":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			record := GeoRecord{Record: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for record_nesting := d.Nesting(); d.NextBlock(record_nesting); {
+				switch option := d.Val(); option {
+				case "country", "continent":
+					values := d.RemainingArgs()
+					if len(values) == 0 {
+						return d.ArgErr()
+					}
+					if option == "country" {
+						record.Countries = append(record.Countries, values...)
+					} else {
+						record.Continents = append(record.Continents, values...)
+					}
+				default:
+					return d.Errf("unrecognized GeoIP record subdirective '%s'", d.Val())
+				}
+			}
+			g.Records = append(g.Records, record)
+		default:
+			return d.Errf("unrecognized GeoIP subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
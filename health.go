@@ -0,0 +1,330 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Records that are only served while their health checks pass, for
+// DNS-level failover between servers. If all records of an RRset are
+// unhealthy, its fallback records are served instead, or all of its
+// records if it has none.
+type HealthChecks struct {
+	// The records & their checks
+	Records []HealthRecord `json:"records,omitempty"`
+
+	// How often to run the checks. Defaults to 30 seconds.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// How long HTTP & TCP checks may take. Defaults to 5 seconds.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	logger    *zap.Logger // set in provision()
+	published []dns.RR    // owned by run()
+}
+
+// A record and how to check whether the server it points to is healthy.
+// Every record (except for fallbacks) has exactly one check.
+type HealthRecord struct {
+	// The record. Placeholders are expanded when the app is provisioned.
+	Record string `json:"record"`
+
+	// The dial address of an upstream of a "reverse_proxy" handler of the
+	// "http" app, which is healthy as long as the reverse proxy considers
+	// it healthy (e.g. according to its active health checks)
+	Upstream string `json:"upstream,omitempty"`
+
+	// A URL which is healthy if a GET request succeeds with a status
+	// below 400
+	HTTP string `json:"http,omitempty"`
+
+	// An address (host:port) which is healthy if it accepts TCP
+	// connections
+	TCP string `json:"tcp,omitempty"`
+
+	// Only serve the record if all others of its RRset are unhealthy
+	Fallback bool `json:"fallback,omitempty"`
+
+	rr dns.RR // set in provision()
+}
+
+func (h *HealthChecks) provision(logger *zap.Logger) error {
+	if h.Interval == 0 {
+		h.Interval = caddy.Duration(30 * time.Second)
+	}
+	if h.Timeout == 0 {
+		h.Timeout = caddy.Duration(5 * time.Second)
+	}
+	h.logger = logger.Named("health")
+	for i := range h.Records {
+		record := &h.Records[i]
+		checks := 0
+		for _, check := range []string{record.Upstream, record.HTTP, record.TCP} {
+			if check != "" {
+				checks += 1
+			}
+		}
+		if checks > 1 || (checks == 0 && !record.Fallback) {
+			return fmt.Errorf("record '%s' requires exactly one health check", record.Record)
+		}
+		rr, err := expand_record(record.Record)
+		if err != nil || rr == nil {
+			return fmt.Errorf("invalid record '%s': %v", record.Record, err)
+		}
+		record.rr = rr
+	}
+	return nil
+}
+
+// Collects the upstreams of all "reverse_proxy" handlers in the routes
+func proxy_upstreams(routes caddyhttp.RouteList, upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	for _, route := range routes {
+		for _, handler := range route.Handlers {
+			switch handler := handler.(type) {
+			case *reverseproxy.Handler:
+				upstreams = append(upstreams, handler.Upstreams...)
+			case *caddyhttp.Subroute:
+				upstreams = proxy_upstreams(handler.Routes, upstreams)
+			}
+		}
+	}
+	return upstreams
+}
+
+// Whether the server the record points to is healthy
+func (h *HealthChecks) check(record *HealthRecord, upstreams []*reverseproxy.Upstream) (bool, error) {
+	timeout := time.Duration(h.Timeout)
+	switch {
+	case record.Upstream != "":
+		found := false
+		for _, upstream := range upstreams {
+			if upstream.Dial != record.Upstream {
+				continue
+			}
+			found = true
+			if !upstream.Healthy() {
+				return false, nil
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("no reverse proxy upstream '%s'", record.Upstream)
+		}
+		return true, nil
+	case record.HTTP != "":
+		client := http.Client{Timeout: timeout}
+		response, err := client.Get(record.HTTP)
+		if err != nil {
+			return false, err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 400 {
+			return false, fmt.Errorf("status %d", response.StatusCode)
+		}
+		return true, nil
+	case record.TCP != "":
+		conn, err := net.DialTimeout("tcp", record.TCP, timeout)
+		if err != nil {
+			return false, err
+		}
+		conn.Close()
+		return true, nil
+	}
+	// fallbacks without a check
+	return true, nil
+}
+
+// The records to serve, given the health of each record
+func (h *HealthChecks) select_records(healthy []bool) []dns.RR {
+	rrsets := map[key][]int{}
+	order := []key{}
+	for i, record := range h.Records {
+		k := rr_key(record.rr)
+		if _, exists := rrsets[k]; !exists {
+			order = append(order, k)
+		}
+		rrsets[k] = append(rrsets[k], i)
+	}
+	records := []dns.RR{}
+	for _, k := range order {
+		primary, fallback, all := []dns.RR{}, []dns.RR{}, []dns.RR{}
+		for _, i := range rrsets[k] {
+			record := h.Records[i]
+			if !record.Fallback {
+				all = append(all, record.rr)
+			}
+			if !healthy[i] {
+				continue
+			}
+			if record.Fallback {
+				fallback = append(fallback, record.rr)
+			} else {
+				primary = append(primary, record.rr)
+			}
+		}
+		switch {
+		case len(primary) > 0:
+			records = append(records, primary...)
+		case len(fallback) > 0:
+			records = append(records, fallback...)
+		default:
+			// serving all records is better than serving none
+			records = append(records, all...)
+		}
+	}
+	return records
+}
+
+// Runs all checks concurrently
+func (h *HealthChecks) check_all(a *App) []bool {
+	upstreams := []*reverseproxy.Upstream{}
+	if a.ctx.AppIsConfigured("http") {
+		app, err := a.ctx.App("http")
+		if err == nil {
+			for _, srv := range app.(*caddyhttp.App).Servers {
+				upstreams = proxy_upstreams(srv.Routes, upstreams)
+			}
+		}
+	}
+	healthy := make([]bool, len(h.Records))
+	var wg sync.WaitGroup
+	for i := range h.Records {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			healthy[i], err = h.check(&h.Records[i], upstreams)
+			if err != nil {
+				h.logger.Debug(
+					"health check failed",
+					zap.String("record", h.Records[i].rr.String()),
+					zap.Error(err),
+				)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return healthy
+}
+
+// The records that are served until the first checks have run
+func (h *HealthChecks) initial_records() []dns.RR {
+	healthy := make([]bool, len(h.Records))
+	for i := range healthy {
+		healthy[i] = true
+	}
+	h.published = h.select_records(healthy)
+	return h.published
+}
+
+// Runs the checks periodically and publishes the healthy records
+func (h *HealthChecks) run(a *App) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-a.shutdown:
+			return
+		}
+		timer.Reset(time.Duration(h.Interval))
+
+		records := h.select_records(h.check_all(a))
+		if same_records(records, h.published) {
+			continue
+		}
+		err := a.replace(h.published, records)
+		if err != nil {
+			h.logger.Error("failed to publish records", zap.Error(err))
+			continue
+		}
+		h.logger.Info(
+			"health changed",
+			zap.Int("published_records", len(records)),
+			zap.Int("record_count", len(h.Records)),
+		)
+		h.published = records
+	}
+}
+
+// Parses a "health_checks" subdirective. Syntax:
+//
+//	health_checks {
+//	    [interval <duration>]
+//	    [timeout <duration>]
+//	    [record "<record>" {
+//	        [upstream <dial address>]
+//	        [http <url>]
+//	        [tcp <address>]
+//	        [fallback]
+//	    }]
+//	}
+func (h *HealthChecks) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "interval", "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			if option == "interval" {
+				h.Interval = caddy.Duration(duration)
+			} else {
+				h.Timeout = caddy.Duration(duration)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "record":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			record := HealthRecord{Record: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for record_nesting := d.Nesting(); d.NextBlock(record_nesting); {
+				switch check := d.Val(); check {
+				case "upstream", "http", "tcp":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					switch check {
+					case "upstream":
+						record.Upstream = d.Val()
+					case "http":
+						record.HTTP = d.Val()
+					case "tcp":
+						record.TCP = d.Val()
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "fallback":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					record.Fallback = true
+				default:
+					return d.Errf("unrecognized health check subdirective '%s'", d.Val())
+				}
+			}
+			h.Records = append(h.Records, record)
+		default:
+			return d.Errf("unrecognized health checks subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
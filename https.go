@@ -0,0 +1,122 @@
+package stub
+
+import (
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/miekg/dns"
+)
+
+// Automatically generated HTTPS records (RFC 9460) for the sites served by
+// Caddy's "http" app, advertising the ports & protocols they are served on.
+type HTTPSRecords struct {
+	// The TTL of the generated records, in seconds. Defaults to 3600.
+	TTL uint32 `json:"ttl,omitempty"`
+}
+
+// The ALPN protocol IDs for the protocols of a Caddy HTTP server.
+// "http/1.1" is part of the default set, and only omitted if disabled.
+func alpn_ids(protocols []string) (ids []string, no_default bool) {
+	no_default = true
+	for _, p := range protocols {
+		switch p {
+		case "h3":
+			ids = append(ids, "h3")
+		case "h2":
+			ids = append(ids, "h2")
+		case "h1":
+			no_default = false
+		}
+	}
+	// h3 is preferred, regardless of the order in the configuration
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, no_default
+}
+
+// Generates the HTTPS records for all sites in the given zones
+func (h *HTTPSRecords) records(app *caddyhttp.App, zones []string) []dns.RR {
+	ttl := h.TTL
+	if ttl == 0 {
+		ttl = 3600
+	}
+
+	records := []dns.RR{}
+	priorities := map[string]uint16{}
+	for _, site := range http_sites(app) {
+		if !site.https {
+			continue
+		}
+		if _, ok := zone_of(site.host, zones); !ok {
+			continue
+		}
+
+		params := []dns.SVCBKeyValue{}
+		ids, no_default := alpn_ids(site.protocols)
+		if len(ids) > 0 {
+			params = append(params, &dns.SVCBAlpn{Alpn: ids})
+		}
+		if no_default {
+			params = append(params, &dns.SVCBNoDefaultAlpn{})
+		}
+		v4, v6 := []net.IP{}, []net.IP{}
+		for _, ip := range site.ips {
+			if ip.To4() != nil {
+				v4 = append(v4, ip)
+			} else {
+				v6 = append(v6, ip)
+			}
+		}
+
+		for _, port := range site.ports {
+			with_port := append([]dns.SVCBKeyValue{}, params...)
+			if port != 443 {
+				with_port = append(with_port, &dns.SVCBPort{Port: port})
+			}
+			if len(v4) > 0 {
+				with_port = append(with_port, &dns.SVCBIPv4Hint{Hint: v4})
+			}
+			if len(v6) > 0 {
+				with_port = append(with_port, &dns.SVCBIPv6Hint{Hint: v6})
+			}
+			priorities[site.host] += 1
+			records = append(records, &dns.HTTPS{SVCB: dns.SVCB{
+				Hdr: dns.RR_Header{
+					Name:   site.host,
+					Rrtype: dns.TypeHTTPS,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Priority: priorities[site.host],
+				Target:   ".",
+				Value:    with_port,
+			}})
+		}
+	}
+	return records
+}
+
+// Parses the block of the "https_records" subdirective
+func (h *HTTPSRecords) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			h.TTL = uint32(ttl)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized HTTPS records subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
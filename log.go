@@ -244,6 +244,9 @@ func (r request) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 		}
 		enc.AddArray("records", zapcore.ArrayMarshalerFunc(array))
 	}
+	if len(r.replaces) > 0 {
+		enc.AddInt("replaces", len(r.replaces))
+	}
 
 	return nil
 }
@@ -0,0 +1,269 @@
+package stub
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// The result of looking up a name & type in the served records
+type lookup_result struct {
+	// RcodeSuccess, or RcodeNameError if the name does not exist
+	rcode int
+
+	// The matching records, if any. Records synthesized from a wildcard
+	// have the queried name as their owner.
+	records []dns.RR
+
+	// The wildcard the result was synthesized from, if any
+	wildcard string
+}
+
+// Looks up the records of the name & type (RFC 4592 section 3.3.1): if the
+// name doesn't exist (not even as an empty non-terminal), the records are
+// synthesized from the wildcard at its closest encloser, if there is one.
+func (srv *Server) lookup(qname string, qtype uint16, zone string) lookup_result {
+	name := strings.ToLower(qname)
+	if records, exists := srv.Records[key_of(name, qtype)]; exists {
+		return lookup_result{rcode: dns.RcodeSuccess, records: records}
+	}
+	if srv.name_in_use(name) {
+		return lookup_result{rcode: dns.RcodeSuccess}
+	}
+	if synthesized, matched := srv.synthesized_records(qname); matched {
+		records := []dns.RR{}
+		for _, record := range synthesized {
+			if record.Header().Rrtype == qtype {
+				records = append(records, record)
+			}
+		}
+		return lookup_result{rcode: dns.RcodeSuccess, records: records}
+	}
+
+	wildcard, exists := srv.wildcard_of(name, zone)
+	if !exists {
+		return lookup_result{rcode: dns.RcodeNameError}
+	}
+	records := []dns.RR{}
+	for _, record := range srv.Records[key_of(wildcard, qtype)] {
+		record = dns.Copy(record)
+		record.Header().Name = qname
+		records = append(records, record)
+	}
+	return lookup_result{
+		rcode:    dns.RcodeSuccess,
+		records:  records,
+		wildcard: wildcard,
+	}
+}
+
+// The wildcard at the closest encloser of a name that doesn't exist, and
+// whether it exists
+func (srv *Server) wildcard_of(name string, zone string) (string, bool) {
+	wildcard := "*." + srv.closest_encloser(name, zone)
+	if wildcard == "*.." {
+		wildcard = "*."
+	}
+	return wildcard, srv.name_in_use(wildcard)
+}
+
+// The records synthesized for a name that has no records of its own:
+// reverse records for the addresses in the prefixes, or the records of the
+// first matching template
+func (srv *Server) synthesized_records(name string) ([]dns.RR, bool) {
+	if records, matched := srv.reverse_records(name); matched {
+		return records, true
+	}
+	return srv.template_records(name)
+}
+
+// Finds the topmost zone cut (a name below the apex of the zone that has NS
+// records) at or above the name. Everything at or below the cut belongs to
+// the delegated zone, except for its DS records.
+func (srv *Server) find_delegation(name string, zone string) (string, bool) {
+	cut, found := "", false
+	if zone == "." {
+		// records outside of the configured zones are served as they are
+		return cut, found
+	}
+	for name != zone && dns.IsSubDomain(zone, name) {
+		if _, ok := srv.Records[key_of(name, dns.TypeNS)]; ok {
+			cut, found = name, true
+		}
+		labels := dns.SplitDomainName(name)
+		name = dns.Fqdn(strings.Join(labels[1:], "."))
+	}
+	return cut, found
+}
+
+// Fills the authority section with a referral to the delegated zone
+// (RFC 1034 section 4.3.2): the NS records of the cut and, if the client
+// asked for it (do) and the zone is signed, its DS records or the proof
+// that there are none. The glue is added along with the other additional
+// records.
+func (srv *Server) refer(m *dns.Msg, zone string, cut string, do bool) error {
+	if len(m.Answer) == 0 {
+		// the records below the cut are not our data
+		m.Authoritative = false
+	}
+	m.Ns = append(m.Ns, srv.Records[key_of(cut, dns.TypeNS)]...)
+	if !do {
+		return nil
+	}
+	if ds := srv.Records[key_of(cut, dns.TypeDS)]; len(ds) > 0 {
+		ns, err := srv.append_rrset(m.Ns, ds, zone, do, "")
+		if err != nil {
+			return err
+		}
+		m.Ns = ns
+		return nil
+	}
+	if signer := srv.signers[zone]; signer != nil {
+		nsec, err := srv.synthesize_nsec(signer, cut)
+		if err != nil {
+			return err
+		}
+		m.Ns = append(m.Ns, nsec...)
+	} else if srv.is_presigned(zone) {
+		srv.presigned_delegation_proof(m, zone, cut)
+	}
+	return nil
+}
+
+// The maximum number of CNAME & DNAME records followed for a query
+const max_chain_length = 8
+
+// The reason for rejecting queries for names outside of the configured zones
+// that have no records of the queried type, which the forwarder or resolver
+// may answer instead
+const reason_not_held = "no such record"
+
+// Finds a DNAME record at an ancestor of the name, within the zone
+func (srv *Server) find_dname(name string, zone string) *dns.DNAME {
+	for name != zone && dns.IsSubDomain(zone, name) {
+		labels := dns.SplitDomainName(name)
+		name = dns.Fqdn(strings.Join(labels[1:], "."))
+		for _, record := range srv.Records[key_of(name, dns.TypeDNAME)] {
+			if dname, ok := record.(*dns.DNAME); ok {
+				return dname
+			}
+		}
+	}
+	return nil
+}
+
+// Answers the query from the served records, following CNAME records and
+// substituting DNAME records (RFC 6672) as long as their targets are served
+// as well. Fills the answer & authority sections and the rcode of the
+// response. Returns the reason for rejecting the query, if it is rejected.
+func (srv *Server) resolve(m *dns.Msg, qname string, qtype uint16, do bool) (string, error) {
+	seen := map[string]bool{}
+	name := qname
+	for {
+		lowercase := strings.ToLower(name)
+		if seen[lowercase] || len(seen) > max_chain_length {
+			srv.logger.Debug(
+				"not following CNAME chain",
+				zap.String("name", name),
+				zap.Bool("loop", seen[lowercase]),
+			)
+			return "", nil
+		}
+		seen[lowercase] = true
+
+		zone, in_zone := srv.answer_zone(lowercase, qtype)
+		if !in_zone {
+			// records outside of the configured zones are still served
+			zone = "."
+		}
+
+		// DS records of a delegated zone are served by the parent
+		cut, delegated := srv.find_delegation(lowercase, zone)
+		if delegated && !(qtype == dns.TypeDS && cut == lowercase) {
+			return "", srv.refer(m, zone, cut, do)
+		}
+
+		if dname := srv.find_dname(lowercase, zone); dname != nil {
+			answer, err := srv.append_rrset(m.Answer, []dns.RR{dname}, zone, do, "")
+			if err != nil {
+				return "", err
+			}
+			m.Answer = answer
+			m.Authoritative = true
+			target := name[:len(name)-len(dname.Hdr.Name)] + dns.Fqdn(dname.Target)
+			if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+				m.Rcode = dns.RcodeYXDomain
+				return "", nil
+			}
+			// the synthesized CNAME is not signed, validators synthesize it
+			// from the DNAME record themselves
+			m.Answer = append(m.Answer, &dns.CNAME{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeCNAME,
+					Class:  dns.ClassINET,
+					Ttl:    dname.Hdr.Ttl,
+				},
+				Target: target,
+			})
+			if qtype == dns.TypeCNAME {
+				return "", nil
+			}
+			name = target
+			continue
+		}
+
+		result := srv.lookup(name, qtype, zone)
+		if len(result.records) == 0 && qtype != dns.TypeCNAME {
+			cname := srv.lookup(name, dns.TypeCNAME, zone)
+			if len(cname.records) > 0 {
+				answer, err := srv.append_rrset(m.Answer, cname.records, zone, do, cname.wildcard)
+				if err != nil {
+					return "", err
+				}
+				m.Answer = answer
+				m.Authoritative = true
+				if cname.wildcard != "" && do && srv.is_presigned(zone) {
+					srv.presigned_wildcard_proof(m, zone, lowercase)
+				}
+				name = cname.records[0].(*dns.CNAME).Target
+				continue
+			}
+		}
+
+		if len(result.records) == 0 {
+			if !in_zone {
+				if len(m.Answer) > 0 {
+					// the target is served elsewhere
+					return "", nil
+				}
+				// names above the records held locally (like the ACME
+				// challenge) are not empty non-terminals of a zone
+				m.Rcode = result.rcode
+				return reason_not_held, nil
+			}
+			m.Authoritative = true
+			m.Rcode = result.rcode
+			return "", srv.append_denial(m, zone, lowercase, do)
+		}
+
+		owner := name
+		if result.wildcard != "" {
+			owner = result.wildcard
+		}
+		signed := do && (srv.signers[zone] != nil || srv.is_presigned(zone))
+		records := srv.order(result.records, owner, qtype, signed)
+		answer, err := srv.append_rrset(m.Answer, records, zone, do, result.wildcard)
+		if err != nil {
+			return "", err
+		}
+		m.Answer = answer
+		m.Authoritative = true
+		if result.wildcard != "" && do && srv.is_presigned(zone) {
+			// prove that the name itself doesn't exist
+			srv.presigned_wildcard_proof(m, zone, lowercase)
+		}
+		return "", nil
+	}
+}
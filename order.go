@@ -0,0 +1,215 @@
+package stub
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// Policies for the order of the records of an RRset in answers
+const (
+	// The order the records were configured in (the default)
+	order_fixed = "fixed"
+
+	// Rotate the records by one for every answer
+	order_round_robin = "round_robin"
+
+	// Shuffle the records for every answer
+	order_random = "random"
+
+	// Select records randomly according to their weights
+	order_weighted = "weighted"
+)
+
+// How the records of an RRset are ordered in answers, for simple load
+// distribution across servers
+type AnswerOrder struct {
+	// The name of the RRset
+	Name string `json:"name"`
+
+	// The type of the RRset, like "A"
+	Type string `json:"type"`
+
+	// "fixed" (the default), "round_robin", "random" or "weighted"
+	Policy string `json:"policy,omitempty"`
+
+	// The weights of the records for the "weighted" policy, by their data
+	// (like "192.0.2.1"). Records without a weight have a weight of 1, and
+	// records with a weight of 0 are only served if all others are too.
+	Weights map[string]int `json:"weights,omitempty"`
+
+	// How many records the "weighted" policy selects. Defaults to 1.
+	Count int `json:"count,omitempty"`
+
+	key     key            // set in provision()
+	weights map[string]int // set in provision(), by canonical data
+	next    int            // owned by Server.main()
+}
+
+// The data of the record, without its header
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+func (o *AnswerOrder) provision() error {
+	name := strings.ToLower(dns.Fqdn(o.Name))
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("invalid name '%s'", o.Name)
+	}
+	rrtype, ok := dns.StringToType[strings.ToUpper(o.Type)]
+	if !ok {
+		return fmt.Errorf("invalid type '%s'", o.Type)
+	}
+	o.key = key_of(name, rrtype)
+	switch o.Policy {
+	case "":
+		o.Policy = order_fixed
+	case order_fixed, order_round_robin, order_random, order_weighted:
+	default:
+		return fmt.Errorf("unknown answer order policy '%s'", o.Policy)
+	}
+	if o.Policy != order_weighted && (len(o.Weights) > 0 || o.Count != 0) {
+		return fmt.Errorf("weights require the weighted policy for %s %s", o.Name, o.Type)
+	}
+	if o.Count < 0 {
+		return fmt.Errorf("invalid count %d for %s %s", o.Count, o.Name, o.Type)
+	}
+	if o.Count == 0 {
+		o.Count = 1
+	}
+	o.weights = map[string]int{}
+	for data, weight := range o.Weights {
+		if weight < 0 {
+			return fmt.Errorf("invalid weight %d for '%s'", weight, data)
+		}
+		// parsing the record normalizes its data
+		rr, err := dns.NewRR(name + " " + dns.TypeToString[rrtype] + " " + data)
+		if err != nil || rr == nil {
+			return fmt.Errorf("invalid record data '%s' for %s %s: %v", data, o.Name, o.Type, err)
+		}
+		o.weights[rdata(rr)] = weight
+	}
+	return nil
+}
+
+// Orders the records randomly, with records of higher weights more likely
+// to come first, and those with a weight of 0 last. Returns the records &
+// how many of them have a weight above 0.
+func (o *AnswerOrder) weighted_order(records []dns.RR) ([]dns.RR, int) {
+	remaining, weights, total := []dns.RR{}, []int{}, 0
+	zero := []dns.RR{}
+	for _, rr := range records {
+		weight, ok := o.weights[rdata(rr)]
+		if !ok {
+			weight = 1
+		}
+		if weight == 0 {
+			zero = append(zero, rr)
+			continue
+		}
+		remaining = append(remaining, rr)
+		weights = append(weights, weight)
+		total += weight
+	}
+	ordered := []dns.RR{}
+	for len(remaining) > 0 {
+		pick := rand.Intn(total)
+		i := 0
+		for pick >= weights[i] {
+			pick -= weights[i]
+			i += 1
+		}
+		ordered = append(ordered, remaining[i])
+		total -= weights[i]
+		remaining = append(remaining[:i], remaining[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return append(ordered, zero...), len(ordered)
+}
+
+// Orders the records of the RRset according to its policy. A signed RRset
+// (signed) is always served in full, since its signature covers all of its
+// records.
+func (srv *Server) order(records []dns.RR, name string, rrtype uint16, signed bool) []dns.RR {
+	o := srv.orders[key_of(strings.ToLower(name), rrtype)]
+	if o == nil || len(records) < 2 {
+		return records
+	}
+	// the records are shared with the server
+	ordered := make([]dns.RR, 0, len(records))
+	switch o.Policy {
+	case order_round_robin:
+		start := o.next % len(records)
+		o.next = start + 1
+		ordered = append(ordered, records[start:]...)
+		ordered = append(ordered, records[:start]...)
+	case order_random:
+		ordered = append(ordered, records...)
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case order_weighted:
+		weighted, selectable := o.weighted_order(records)
+		ordered = weighted
+		if !signed && selectable > 0 {
+			count := o.Count
+			if count > selectable {
+				count = selectable
+			}
+			ordered = ordered[:count]
+		}
+	default:
+		return records
+	}
+	return ordered
+}
+
+// Parses an "answer_order" subdirective. Syntax:
+//
+//	answer_order <name> <type> fixed|round_robin|random|weighted {
+//	    [weight <data> <weight>]
+//	    [count <count>]
+//	}
+func (o *AnswerOrder) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) != 3 {
+		return d.ArgErr()
+	}
+	o.Name, o.Type, o.Policy = args[0], args[1], args[2]
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "weight":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			weight, err := strconv.Atoi(args[1])
+			if err != nil || weight < 0 {
+				return d.Errf("invalid weight '%s'", args[1])
+			}
+			if o.Weights == nil {
+				o.Weights = map[string]int{}
+			}
+			o.Weights[args[0]] = weight
+		case "count":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			count, err := strconv.Atoi(d.Val())
+			if err != nil || count < 1 {
+				return d.Errf("invalid count '%s'", d.Val())
+			}
+			o.Count = count
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized answer order subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
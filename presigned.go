@@ -0,0 +1,249 @@
+package stub
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// A zone file to load records from
+type ZoneFile struct {
+	// The path of the zone file
+	Path string `json:"path"`
+
+	// The origin of relative names in the file, unless set with $ORIGIN
+	Origin string `json:"origin,omitempty"`
+}
+
+// Loads the records of a zone file
+func (z ZoneFile) load() ([]static_record, error) {
+	file, err := os.Open(z.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []static_record{}
+	parser := dns.NewZoneParser(file, dns.Fqdn(z.Origin), z.Path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		records = append(records, static_record{template: rr.String(), rr: rr})
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Whether a is before b in the canonical ordering of names (RFC 4034
+// section 6.1)
+func canonical_less(a string, b string) bool {
+	labels_a := dns.SplitDomainName(strings.ToLower(a))
+	labels_b := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(labels_a) && i <= len(labels_b); i++ {
+		label_a, label_b := labels_a[len(labels_a)-i], labels_b[len(labels_b)-i]
+		if label_a != label_b {
+			return label_a < label_b
+		}
+	}
+	return len(labels_a) < len(labels_b)
+}
+
+// Whether the NSEC record proves that the name does not exist
+func nsec_covers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonical_less(owner, next) {
+		return canonical_less(owner, name) && canonical_less(name, next)
+	}
+	// the last NSEC record of the zone wraps around to the apex
+	return canonical_less(owner, name) || canonical_less(name, next)
+}
+
+// Whether there are any records at or below the name, i.e. whether it
+// exists, possibly as an empty non-terminal
+func (srv *Server) name_in_use(name string) bool {
+	name = strings.ToLower(name)
+	for key := range srv.Records {
+		if dns.IsSubDomain(name, key.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// The longest ancestor of the name (or the name itself) that exists in the
+// zone
+func (srv *Server) closest_encloser(name string, zone string) string {
+	name = strings.ToLower(name)
+	for name != zone && dns.IsSubDomain(zone, name) {
+		if srv.name_in_use(name) {
+			return name
+		}
+		labels := dns.SplitDomainName(name)
+		name = dns.Fqdn(strings.Join(labels[1:], "."))
+	}
+	return zone
+}
+
+// The zone that answers for the name & type. DS records belong to the
+// parent side of a zone cut, so they are answered from the parent zone,
+// if it is served as well.
+func (srv *Server) answer_zone(name string, qtype uint16) (string, bool) {
+	name = dns.CanonicalName(name)
+	zone, ok := zone_of(name, srv.Zones)
+	if ok && qtype == dns.TypeDS && zone == name && name != "." {
+		labels := dns.SplitDomainName(name)
+		if parent, ok := zone_of(dns.Fqdn(strings.Join(labels[1:], ".")), srv.Zones); ok {
+			return parent, true
+		}
+	}
+	return zone, ok
+}
+
+// Whether the zone contains signatures, i.e. it was signed before loading
+func (srv *Server) is_presigned(zone string) bool {
+	_, signed := srv.Records[key_of(zone, dns.TypeRRSIG)]
+	return signed && srv.signers[zone] == nil
+}
+
+// The stored signatures of the RRset that were made by the zone
+func (srv *Server) covering_rrsigs(name string, rrtype uint16, zone string) []dns.RR {
+	rrsigs := []dns.RR{}
+	for _, rr := range srv.Records[key_of(name, dns.TypeRRSIG)] {
+		rrsig, ok := rr.(*dns.RRSIG)
+		if ok && rrsig.TypeCovered == rrtype && strings.EqualFold(rrsig.SignerName, zone) {
+			rrsigs = append(rrsigs, rrsig)
+		}
+	}
+	return rrsigs
+}
+
+// Appends the RRset along with its stored signatures to the section
+func (srv *Server) append_presigned(section []dns.RR, rrset []dns.RR, zone string) []dns.RR {
+	if len(rrset) == 0 {
+		return section
+	}
+	hdr := rrset[0].Header()
+	section = append(section, rrset...)
+	return append(section, srv.covering_rrsigs(hdr.Name, hdr.Rrtype, zone)...)
+}
+
+// The NSEC & NSEC3 records of the zone
+func (srv *Server) denial_records(zone string) ([]*dns.NSEC, []*dns.NSEC3) {
+	nsecs := []*dns.NSEC{}
+	nsec3s := []*dns.NSEC3{}
+	for key, rrset := range srv.Records {
+		if !dns.IsSubDomain(zone, key.Name) {
+			continue
+		}
+		// at a zone cut, the NSEC records of both zones exist, and
+		// subzones may be signed as well
+		if len(srv.covering_rrsigs(key.Name, uint16(key.Type), zone)) == 0 {
+			continue
+		}
+		for _, rr := range rrset {
+			switch denial := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, denial)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, denial)
+			}
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// Appends the NSEC or NSEC3 record (and its signatures) that proves that
+// the name doesn't exist, to an answer synthesized from a wildcard
+// (RFC 4035 section 3.1.3.3)
+func (srv *Server) presigned_wildcard_proof(m *dns.Msg, zone string, name string) {
+	nsecs, nsec3s := srv.denial_records(zone)
+	for _, nsec := range nsecs {
+		if nsec_covers(nsec, name) {
+			m.Ns = srv.append_presigned(m.Ns, []dns.RR{nsec}, zone)
+			return
+		}
+	}
+	encloser := srv.closest_encloser(name, zone)
+	labels := dns.SplitDomainName(name)
+	next_closer := dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(encloser)-1:], "."))
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(next_closer) {
+			m.Ns = srv.append_presigned(m.Ns, []dns.RR{nsec3}, zone)
+			return
+		}
+	}
+}
+
+// Appends the NSEC or NSEC3 records (and their signatures) that prove that
+// the name (or, for NODATA, the type) does not exist, along with the SOA
+// record. For NXDOMAIN, the proof includes the non-existence of a matching
+// wildcard.
+func (srv *Server) presigned_denial(m *dns.Msg, zone string, name string, nodata bool) {
+	name = strings.ToLower(name)
+	m.Ns = srv.append_presigned(m.Ns, srv.Records[key_of(zone, dns.TypeSOA)], zone)
+
+	included := map[string]bool{}
+	include := func(rr dns.RR) {
+		if included[rr.String()] {
+			return
+		}
+		included[rr.String()] = true
+		m.Ns = srv.append_presigned(m.Ns, []dns.RR{rr}, zone)
+	}
+
+	nsecs, nsec3s := srv.denial_records(zone)
+	if len(nsecs) > 0 {
+		if nodata {
+			for _, nsec := range nsecs {
+				if strings.EqualFold(nsec.Hdr.Name, name) {
+					include(nsec)
+				}
+			}
+			return
+		}
+		wildcard := "*." + srv.closest_encloser(name, zone)
+		for _, nsec := range nsecs {
+			if nsec_covers(nsec, name) || nsec_covers(nsec, wildcard) {
+				include(nsec)
+			}
+		}
+		return
+	}
+
+	if nodata {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				include(nsec3)
+			}
+		}
+		return
+	}
+	// closest encloser proof (RFC 5155 section 7.2.1)
+	encloser := srv.closest_encloser(name, zone)
+	labels := dns.SplitDomainName(name)
+	next_closer := dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(encloser)-1:], "."))
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(encloser) || nsec3.Cover(next_closer) || nsec3.Cover("*."+encloser) {
+			include(nsec3)
+		}
+	}
+}
+
+// Appends the NSEC or NSEC3 record (and its signatures) that proves that
+// there is no DS record at the zone cut, i.e. that the delegation is insecure
+func (srv *Server) presigned_delegation_proof(m *dns.Msg, zone string, cut string) {
+	nsecs, nsec3s := srv.denial_records(zone)
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, cut) {
+			m.Ns = srv.append_presigned(m.Ns, []dns.RR{nsec}, zone)
+			return
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(cut) {
+			m.Ns = srv.append_presigned(m.Ns, []dns.RR{nsec3}, zone)
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// A statically configured record, which may contain placeholders
+type static_record struct {
+	template string
+	dynamic  bool   // depends on the addresses of the network interfaces
+	rr       dns.RR // the record with all placeholders expanded
+}
+
+// Expands the placeholders in a record, including the special
+// {iface.<name>.ipv4} and {iface.<name>.ipv6} placeholders which expand to
+// an address of the named network interface. The interface name "default"
+// refers to the interface of the default route. Unknown placeholders are
+// kept as they are, since records can contain braces (e.g. JSON in TXT
+// records).
+func expand_record(template string) (dns.RR, error) {
+	if !strings.ContainsAny(template, "{}") {
+		return dns.NewRR(template)
+	}
+	repl := caddy.NewReplacer()
+	var lookup_err error
+	repl.Map(func(key string) (any, bool) {
+		if !strings.HasPrefix(key, "iface.") {
+			return nil, false
+		}
+		dot := strings.LastIndex(key, ".")
+		if dot <= len("iface.") || (key[dot+1:] != "ipv4" && key[dot+1:] != "ipv6") {
+			lookup_err = fmt.Errorf("invalid placeholder {%s}, expected {iface.<name>.ipv4} or {iface.<name>.ipv6}", key)
+			return nil, false
+		}
+		name, family := key[len("iface."):dot], key[dot+1:]
+		ip, err := interface_address(name, family == "ipv6")
+		if err != nil {
+			lookup_err = err
+			return nil, false
+		}
+		return ip.String(), true
+	})
+	expanded, err := repl.ReplaceOrErr(template, true, false)
+	if lookup_err != nil {
+		return nil, lookup_err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dns.NewRR(expanded)
+}
+
+func is_dynamic(template string) bool {
+	return strings.Contains(template, "{iface.")
+}
+
+// Finds the (preferred) address of the given family of an interface
+func interface_address(name string, v6 bool) (net.IP, error) {
+	if name == "default" {
+		return default_address(v6)
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var fallback net.IP
+	for _, addr := range addrs {
+		ip_net, ok := addr.(*net.IPNet)
+		if !ok || (ip_net.IP.To4() == nil) != v6 {
+			continue
+		}
+		if ip_net.IP.IsGlobalUnicast() {
+			return ip_net.IP, nil
+		}
+		if fallback == nil {
+			fallback = ip_net.IP
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("interface '%s' has no suitable address", name)
+	}
+	return fallback, nil
+}
+
+// Finds the source address the host would use to reach the internet.
+// This does not actually send any packets.
+func default_address(v6 bool) (net.IP, error) {
+	network, target := "udp4", "192.0.2.1:53"
+	if v6 {
+		network, target = "udp6", "[2001:db8::1]:53"
+	}
+	conn, err := net.Dial(network, target)
+	if err != nil {
+		return nil, fmt.Errorf("no default route: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Parses the statically configured records
+func parse_records(templates []string) ([]static_record, error) {
+	records := []static_record{}
+	for _, template := range templates {
+		rr, err := expand_record(template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record '%s': %v", template, err)
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("invalid empty record '%s'", template)
+		}
+		records = append(records, static_record{
+			template: template,
+			dynamic:  is_dynamic(template),
+			rr:       rr,
+		})
+	}
+	return records, nil
+}
+
+// Re-evaluates the records that depend on the addresses of the network
+// interfaces, and updates the served records when they change.
+func (a *App) watch_interfaces() {
+	ticker := time.NewTicker(time.Duration(a.InterfaceInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.shutdown:
+			return
+		}
+		previous := []dns.RR{}
+		updated := []dns.RR{}
+		changed := []int{}
+		for i, record := range a.static {
+			if !record.dynamic {
+				continue
+			}
+			rr, err := expand_record(record.template)
+			if err != nil {
+				a.logger.Warn(
+					"failed to update record",
+					zap.String("record", record.template),
+					zap.Error(err),
+				)
+				continue
+			}
+			if rr.String() == record.rr.String() {
+				continue
+			}
+			a.logger.Info(
+				"interface address changed",
+				zap.String("previous", record.rr.String()),
+				zap.String("updated", rr.String()),
+			)
+			previous = append(previous, record.rr)
+			updated = append(updated, rr)
+			changed = append(changed, i)
+		}
+		if len(updated) == 0 {
+			continue
+		}
+		err := a.replace(previous, updated)
+		if err != nil {
+			// retried with the next tick
+			a.logger.Error("failed to update records", zap.Error(err))
+			continue
+		}
+		for j, i := range changed {
+			a.static[i].rr = updated[j]
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// A caching forwarder to upstream (recursive) resolvers, for clients on the
+// allowed networks. Queries that ask for recursion (RD bit) are answered
+// from the records of the server if it holds the name, and from the cache
+// or by the upstream resolvers otherwise.
+type Resolver struct {
+	// The addresses of the upstream resolvers, tried in turn. Defaults to
+	// port 53.
+	Upstreams []string `json:"upstreams"`
+
+	// The networks (in CIDR notation) or addresses of the clients that may
+	// use the resolver
+	Allow []string `json:"allow"`
+
+	// How long to wait for a response from an upstream. Defaults to 2
+	// seconds.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// How often to send a query before giving up. Every attempt goes to the
+	// next upstream. Defaults to 3.
+	Attempts int `json:"attempts,omitempty"`
+
+	// The maximum number of cached responses. Defaults to 10000.
+	CacheSize int `json:"cache_size,omitempty"`
+
+	// How long after they expired cached responses are served when the
+	// upstreams can't be reached or are slow to respond (RFC 8767).
+	// Disabled by default.
+	ServeStale caddy.Duration `json:"serve_stale,omitempty"`
+
+	// Refresh cached responses that are still being queried shortly before
+	// they expire
+	Prefetch bool `json:"prefetch,omitempty"`
+
+	logger   *zap.Logger    // set in provision()
+	networks []*net.IPNet   // set in provision()
+	upstream *Forward       // set in provision()
+	mu       *sync.Mutex    // set in provision(), guards cache
+	cache    resolver_cache // set in provision()
+}
+
+type cache_key struct {
+	name  string
+	qtype uint16
+	do    bool
+}
+
+type cache_entry struct {
+	response   *dns.Msg
+	stored     time.Time
+	ttl        time.Duration
+	refreshing bool
+}
+
+type resolver_cache map[cache_key]*cache_entry
+
+const (
+	// The longest time responses are cached
+	resolver_max_ttl = 24 * time.Hour
+
+	// The TTL of stale records (RFC 8767 section 4)
+	resolver_stale_ttl = 30
+
+	// How long to wait for the upstreams before serving a stale response
+	// (the client response timer of RFC 8767 section 5)
+	resolver_stale_timeout = 1800 * time.Millisecond
+
+	// Responses are prefetched when this fraction of their TTL is left
+	resolver_prefetch_fraction = 10
+)
+
+func (r *Resolver) provision(logger *zap.Logger) error {
+	if len(r.Upstreams) == 0 {
+		return fmt.Errorf("resolver requires an upstream")
+	}
+	if len(r.Allow) == 0 {
+		// don't become an open resolver
+		return fmt.Errorf("resolver requires allowed networks")
+	}
+	networks, err := parse_networks(r.Allow)
+	if err != nil {
+		return err
+	}
+	r.networks = networks
+	if r.CacheSize == 0 {
+		r.CacheSize = 10000
+	}
+	r.logger = logger.Named("resolver")
+	r.upstream = &Forward{
+		Upstreams: r.Upstreams,
+		Timeout:   r.Timeout,
+		Attempts:  r.Attempts,
+	}
+	err = r.upstream.provision(r.logger)
+	if err != nil {
+		return err
+	}
+	r.Timeout, r.Attempts = r.upstream.Timeout, r.upstream.Attempts
+	r.mu = &sync.Mutex{}
+	r.cache = resolver_cache{}
+	return nil
+}
+
+// Whether the client may use the resolver for the query
+func (r *Resolver) allows(q query) bool {
+	return q.r.RecursionDesired && networks_contain(r.networks, address_ip(q.w.RemoteAddr()))
+}
+
+// How long the response may be cached: the lowest TTL of its records, or
+// the negative caching TTL of the SOA record for negative responses
+func cache_ttl(m *dns.Msg) (time.Duration, bool) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+	ttl, found := uint32(0), false
+	for _, rr := range append(append([]dns.RR{}, m.Answer...), m.Ns...) {
+		rr_ttl := rr.Header().Ttl
+		if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 && soa.Minttl < rr_ttl {
+			rr_ttl = soa.Minttl
+		}
+		if !found || rr_ttl < ttl {
+			ttl, found = rr_ttl, true
+		}
+	}
+	if !found || ttl == 0 {
+		return 0, false
+	}
+	duration := time.Duration(ttl) * time.Second
+	if duration > resolver_max_ttl {
+		duration = resolver_max_ttl
+	}
+	return duration, true
+}
+
+// Copies the response with the TTLs of its records reduced by its age
+func aged(m *dns.Msg, age time.Duration, stale bool) *dns.Msg {
+	m = m.Copy()
+	elapsed := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			switch {
+			case hdr.Rrtype == dns.TypeOPT:
+			case stale:
+				hdr.Ttl = resolver_stale_ttl
+			case hdr.Ttl > elapsed:
+				hdr.Ttl -= elapsed
+			default:
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// Looks up a response in the cache. Expired responses are returned as
+// stale (not fresh), as long as they may still be served.
+func (r *Resolver) cached(k cache_key, now time.Time) (response *dns.Msg, fresh bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[k]
+	if !ok {
+		return nil, false
+	}
+	age := now.Sub(entry.stored)
+	if age >= entry.ttl {
+		if age >= entry.ttl+time.Duration(r.ServeStale) {
+			delete(r.cache, k)
+			return nil, false
+		}
+		return aged(entry.response, age, true), false
+	}
+	if r.Prefetch && !entry.refreshing && entry.ttl-age < entry.ttl/resolver_prefetch_fraction {
+		entry.refreshing = true
+		go r.refresh(k)
+	}
+	return aged(entry.response, age, false), true
+}
+
+// Caches the response, making room for it if the cache is full
+func (r *Resolver) store(k cache_key, response *dns.Msg, now time.Time) {
+	ttl, ok := cache_ttl(response)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.cache[k]; !exists && len(r.cache) >= r.CacheSize {
+		for key, entry := range r.cache {
+			if now.Sub(entry.stored) >= entry.ttl+time.Duration(r.ServeStale) {
+				delete(r.cache, key)
+			}
+		}
+		for key := range r.cache {
+			if len(r.cache) < r.CacheSize {
+				break
+			}
+			delete(r.cache, key)
+		}
+	}
+	r.cache[k] = &cache_entry{response: response, stored: now, ttl: ttl}
+}
+
+// Queries the upstreams (retrying over TCP if the response is truncated)
+// and caches the response
+func (r *Resolver) refresh(k cache_key) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(k.name, k.qtype)
+	m.SetEdns0(edns_buffer_size, k.do)
+	response, err := r.upstream.exchange(m, "udp")
+	if err == nil && response.Truncated {
+		response, err = r.upstream.exchange(m, "tcp")
+	}
+	if err != nil {
+		r.mu.Lock()
+		if entry, ok := r.cache[k]; ok {
+			entry.refreshing = false
+		}
+		r.mu.Unlock()
+		return nil, err
+	}
+	r.store(k, response, time.Now())
+	return response.Copy(), nil
+}
+
+// Marks the cached response as being refreshed, unless it already is
+func (r *Resolver) start_refresh(k cache_key) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[k]
+	if !ok || entry.refreshing {
+		return false
+	}
+	entry.refreshing = true
+	return true
+}
+
+// Queries the upstreams for a response that isn't cached (stale is nil)
+// or has expired. Stale responses are served if the upstreams fail or take
+// longer than the client response timer, while the refresh continues in
+// the background (RFC 8767 section 5).
+func (r *Resolver) resolve_upstream(q query, k cache_key, stale *dns.Msg) (*dns.Msg, string) {
+	if stale != nil && !r.start_refresh(k) {
+		// another query is already waiting for the upstreams
+		return stale, "serving stale"
+	}
+	type result struct {
+		response *dns.Msg
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		response, err := r.refresh(k)
+		done <- result{response, err}
+	}()
+	var timeout <-chan time.Time
+	if stale != nil {
+		timer := time.NewTimer(resolver_stale_timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case res := <-done:
+		switch {
+		case res.err == nil:
+			return res.response, "resolved"
+		case stale != nil:
+			return stale, "serving stale"
+		}
+		r.logger.Warn(
+			"resolving failed",
+			zap.Stringer("address", q.w.RemoteAddr()),
+			zap.Error(res.err),
+		)
+		response := new(dns.Msg)
+		response.SetRcode(q.r, dns.RcodeServerFailure)
+		response.RecursionAvailable = true
+		return response, "resolving failed"
+	case <-timeout:
+		return stale, "serving stale"
+	}
+}
+
+// Answers the query from the cache or by the upstreams. Runs outside of
+// the main loop, so that slow upstreams don't hold up other queries.
+func (r *Resolver) resolve(q query) {
+	qstn := q.r.Question[0]
+	k := cache_key{
+		name:  strings.ToLower(qstn.Name),
+		qtype: qstn.Qtype,
+		do:    dnssec_ok(q.r),
+	}
+	reason := "cached"
+	response, fresh := r.cached(k, time.Now())
+	if !fresh {
+		response, reason = r.resolve_upstream(q, k, response)
+	}
+
+	response.Id = q.r.Id
+	response.Question = q.r.Question
+	if q.r.IsEdns0() == nil {
+		extra := []dns.RR{}
+		for _, rr := range response.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		response.Extra = extra
+	}
+	r.logger.Debug(
+		"answering query",
+		zap.Stringer("address", q.w.RemoteAddr()),
+		zap.String("reason", reason),
+		zap.Object("response", LoggableDNSMsg{response}),
+	)
+	write_response(q, response)
+}
+
+// Parses a "resolver" subdirective. Syntax:
+//
+//	resolver [<upstream...>] {
+//	    [upstream <address...>]
+//	    allow <network...>
+//	    [timeout <duration>]
+//	    [attempts <count>]
+//	    [cache_size <count>]
+//	    [serve_stale <duration>]
+//	    [prefetch]
+//	}
+func (r *Resolver) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	r.Upstreams = append(r.Upstreams, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "upstream", "allow":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return d.ArgErr()
+			}
+			if option == "upstream" {
+				r.Upstreams = append(r.Upstreams, values...)
+			} else {
+				r.Allow = append(r.Allow, values...)
+			}
+		case "timeout", "serve_stale":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			if option == "timeout" {
+				r.Timeout = caddy.Duration(duration)
+			} else {
+				r.ServeStale = caddy.Duration(duration)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "attempts", "cache_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			count, err := strconv.Atoi(d.Val())
+			if err != nil || count < 1 {
+				return d.Errf("invalid %s '%s'", option, d.Val())
+			}
+			if option == "attempts" {
+				r.Attempts = count
+			} else {
+				r.CacheSize = count
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "prefetch":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			r.Prefetch = true
+		default:
+			return d.Errf("unrecognized resolver subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
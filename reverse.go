@@ -0,0 +1,291 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// PTR records synthesized for the addresses in some prefixes (reverse
+// DNS), pointing to the names of the A/AAAA records with the address.
+// Addresses without such records can point to a name generated from the
+// address instead.
+type Reverse struct {
+	// The prefixes (in CIDR notation), e.g. 2001:db8::/48
+	Prefixes []string `json:"prefixes"`
+
+	// The name for addresses without A/AAAA records, if any. Can contain
+	// {ip} for the address, and {ip.dashed} for the address with dashes
+	// instead of dots & colons, e.g. "ip-{ip.dashed}.example.com.".
+	Fallback string `json:"fallback,omitempty"`
+
+	// The TTL of the fallback records, in seconds. Defaults to 3600.
+	TTL uint32 `json:"ttl,omitempty"`
+
+	networks []*net.IPNet // set in provision()
+}
+
+func (r *Reverse) provision() error {
+	if len(r.Prefixes) == 0 {
+		return fmt.Errorf("reverse records require prefixes")
+	}
+	networks, err := parse_networks(r.Prefixes)
+	if err != nil {
+		return err
+	}
+	r.networks = networks
+	if r.TTL == 0 {
+		r.TTL = 3600
+	}
+	if r.Fallback != "" {
+		target, err := r.fallback_target(net.ParseIP("2001:db8::1"))
+		if err != nil {
+			return fmt.Errorf("invalid reverse fallback '%s': %v", r.Fallback, err)
+		}
+		if _, ok := dns.IsDomainName(target); !ok {
+			return fmt.Errorf("invalid reverse fallback '%s'", r.Fallback)
+		}
+	}
+	return nil
+}
+
+// The network of a reverse name (in in-addr.arpa. or ip6.arpa.), e.g.
+// 192.0.2.0/24 for 2.0.192.in-addr.arpa., or nil. Names of addresses have
+// all bits of the address.
+func reverse_network(name string) *net.IPNet {
+	name = strings.ToLower(dns.Fqdn(name))
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) > net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, octet := range octets {
+			value, err := strconv.ParseUint(octet, 10, 8)
+			if err != nil || strconv.FormatUint(value, 10) != octet {
+				return nil
+			}
+			ip[len(octets)-1-i] = byte(value)
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(octets), 8*net.IPv4len)}
+	}
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) > 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			value, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			position := len(nibbles) - 1 - i
+			ip[position/2] |= byte(value) << (4 * (1 - position%2))
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(4*len(nibbles), 8*net.IPv6len)}
+	}
+	return nil
+}
+
+// Whether the network is one of the prefixes or within one
+func within_prefixes(network *net.IPNet, prefixes []*net.IPNet) bool {
+	bits, _ := network.Mask.Size()
+	for _, prefix := range prefixes {
+		prefix_bits, _ := prefix.Mask.Size()
+		if len(prefix.IP) == len(network.IP) && bits >= prefix_bits && prefix.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// The name of the fallback record for the address
+func (r *Reverse) fallback_target(ip net.IP) (string, error) {
+	repl := caddy.NewReplacer()
+	repl.Set("ip", ip.String())
+	repl.Set("ip.dashed", strings.NewReplacer(".", "-", ":", "-").Replace(ip.String()))
+	target, err := repl.ReplaceOrErr(r.Fallback, true, true)
+	if err != nil {
+		return "", err
+	}
+	return dns.Fqdn(target), nil
+}
+
+// The address of an A/AAAA record that PTR records can point to, i.e. not
+// of a wildcard
+func record_address(rr dns.RR) (net.IP, bool) {
+	if strings.HasPrefix(rr.Header().Name, "*.") {
+		return nil, false
+	}
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A, true
+	case *dns.AAAA:
+		return rr.AAAA, true
+	}
+	return nil, false
+}
+
+// The (lowercase) names of the A/AAAA records by address, counting the
+// records of each name
+type address_index map[string]map[string]int
+
+func (index address_index) add(rr dns.RR) {
+	address, ok := record_address(rr)
+	if !ok {
+		return
+	}
+	names := index[address.String()]
+	if names == nil {
+		names = map[string]int{}
+		index[address.String()] = names
+	}
+	names[strings.ToLower(rr.Header().Name)] += 1
+}
+
+func (index address_index) remove(rr dns.RR) {
+	address, ok := record_address(rr)
+	if !ok {
+		return
+	}
+	names := index[address.String()]
+	name := strings.ToLower(rr.Header().Name)
+	if names[name] -= 1; names[name] <= 0 {
+		delete(names, name)
+	}
+	if len(names) == 0 {
+		delete(index, address.String())
+	}
+}
+
+// The names with the address in any of the indexes
+func candidate_names(ip net.IP, indexes ...address_index) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, index := range indexes {
+		for name := range index[ip.String()] {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// The PTR records synthesized for the reverse name, if it is in one of the
+// prefixes & has any. Names of networks within the prefixes exist without
+// records, so that resolvers don't consider the addresses below them to
+// not exist (RFC 8020).
+func (srv *Server) reverse_records(qname string) ([]dns.RR, bool) {
+	if srv.Reverse == nil {
+		return nil, false
+	}
+	network := reverse_network(qname)
+	if network == nil || !within_prefixes(network, srv.Reverse.networks) {
+		return nil, false
+	}
+	if bits, size := network.Mask.Size(); bits < size {
+		return []dns.RR{}, true
+	}
+	ip := network.IP
+	targets, ttl := []string{}, uint32(0)
+	// the indexes only name candidates, the records served to the client
+	// (e.g. in its view) decide whether the name still has the address
+	for _, name := range candidate_names(ip, srv.addresses, srv.override_addresses) {
+		found := false
+		for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			for _, rr := range srv.Records[key_of(name, rrtype)] {
+				if address, ok := record_address(rr); !ok || !address.Equal(ip) {
+					continue
+				}
+				// the PTR records share the lowest TTL of the address records
+				if (len(targets) == 0 && !found) || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+				found = true
+				break
+			}
+		}
+		if found {
+			targets = append(targets, name)
+		}
+	}
+	if len(targets) == 0 {
+		if srv.Reverse.Fallback == "" {
+			return nil, false
+		}
+		target, err := srv.Reverse.fallback_target(ip)
+		if err != nil {
+			srv.logger.Debug("failed to render reverse fallback", zap.Stringer("ip", ip), zap.Error(err))
+			return nil, false
+		}
+		targets, ttl = []string{target}, srv.Reverse.TTL
+	}
+	sort.Strings(targets)
+	records := []dns.RR{}
+	for _, target := range targets {
+		records = append(records, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   qname,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ptr: target,
+		})
+	}
+	return records, true
+}
+
+// Parses a "reverse" subdirective. Syntax:
+//
+//	reverse [<prefix...>] {
+//	    [prefix <prefix...>]
+//	    [fallback <name>]
+//	    [ttl <seconds>]
+//	}
+func (r *Reverse) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	r.Prefixes = append(r.Prefixes, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "prefix":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return d.ArgErr()
+			}
+			r.Prefixes = append(r.Prefixes, values...)
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			r.Fallback = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			r.TTL = uint32(ttl)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized reverse subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// A zone transferred from a primary server (AXFR & IXFR), which is served
+// next to the other records. The zone is transferred on startup, whenever
+// the primary sends a NOTIFY, and according to the timers in its SOA record.
+type Secondary struct {
+	// The name of the zone
+	Zone string `json:"zone"`
+
+	// The addresses of the primary servers, tried in order. Defaults to
+	// port 53. NOTIFY messages are only accepted from these addresses.
+	Primaries []string `json:"primaries"`
+
+	// The name of the TSIG key (from the "tsig_keys" of the app) to sign
+	// the transfers with
+	Key string `json:"key,omitempty"`
+
+	logger  *zap.Logger   // set in provision()
+	key     *TSIGKey      // set in provision()
+	refresh chan struct{} // set in provision()
+
+	mu          *sync.Mutex // set in provision(), guards primary_ips
+	primary_ips []net.IP    // set by run()
+
+	soa       *dns.SOA  // owned by run()
+	published []dns.RR  // owned by run()
+	refreshed time.Time // owned by run()
+}
+
+// Timers used until the SOA record of the zone is known
+const (
+	secondary_retry  = 5 * time.Minute
+	secondary_expire = 7 * 24 * time.Hour
+)
+
+// The shortest refresh & retry intervals, regardless of the SOA record
+const secondary_minimum = 1 * time.Minute
+
+func (s *Secondary) provision(logger *zap.Logger, keys []TSIGKey) error {
+	if s.Zone == "" || len(s.Primaries) == 0 {
+		return fmt.Errorf("secondary zone requires a name and a primary")
+	}
+	s.Zone = dns.CanonicalName(s.Zone)
+	s.logger = logger.Named("secondary").With(zap.String("zone", s.Zone))
+	s.refresh = make(chan struct{}, 1)
+	s.mu = new(sync.Mutex)
+	for i, addr := range s.Primaries {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			s.Primaries[i] = net.JoinHostPort(addr, "53")
+		}
+	}
+	if s.Key != "" {
+		for i := range keys {
+			if keys[i].Name == dns.CanonicalName(s.Key) {
+				s.key = &keys[i]
+			}
+		}
+		if s.key == nil {
+			return fmt.Errorf("unknown TSIG key '%s'", s.Key)
+		}
+	}
+	return nil
+}
+
+// Resolves the addresses of the primaries, for accepting their NOTIFY
+// messages. Primaries configured by name are looked up here rather than for
+// every NOTIFY, since the server mustn't block on lookups.
+func (s *Secondary) resolve_primaries() {
+	ips := []net.IP{}
+	for _, primary := range s.Primaries {
+		host, _, _ := net.SplitHostPort(primary)
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			s.logger.Warn(
+				"failed to resolve primary",
+				zap.String("primary", primary),
+				zap.Error(err),
+			)
+			continue
+		}
+		ips = append(ips, addrs...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.primary_ips = ips
+}
+
+// Whether the address is the one of a primary
+func (s *Secondary) is_primary(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, primary_ip := range s.primary_ips {
+		if primary_ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether serial a is newer than serial b (RFC 1982 serial arithmetic)
+func serial_newer(a uint32, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// Requests the zone from a primary: incrementally (IXFR) if it has been
+// transferred before, completely (AXFR) otherwise.
+func (s *Secondary) transfer(primary string) (records []dns.RR, err error) {
+	m := new(dns.Msg)
+	if s.soa != nil {
+		m.SetIxfr(s.Zone, s.soa.Serial, s.soa.Ns, s.soa.Mbox)
+	} else {
+		m.SetAxfr(s.Zone)
+	}
+	tr := new(dns.Transfer)
+	tr.DialTimeout = 5 * time.Second
+	tr.ReadTimeout = 10 * time.Second
+	if s.key != nil {
+		tr.TsigSecret = map[string]string{s.key.Name: s.key.Secret}
+		m.SetTsig(s.key.Name, s.key.Algorithm, 300, time.Now().Unix())
+	}
+	envelopes, err := tr.In(m, primary)
+	if err != nil {
+		return nil, err
+	}
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			err = envelope.Error
+			continue
+		}
+		records = append(records, envelope.RR...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty transfer")
+	}
+	if _, ok := records[0].(*dns.SOA); !ok {
+		return nil, fmt.Errorf("transfer does not start with SOA")
+	}
+	return records, nil
+}
+
+// Applies the response to a transfer to the published records, returning
+// the new set of records, or nil if nothing changed.
+func (s *Secondary) apply(response []dns.RR) ([]dns.RR, error) {
+	soa := response[0].(*dns.SOA)
+	if s.soa != nil && !serial_newer(soa.Serial, s.soa.Serial) {
+		return nil, nil
+	}
+	if len(response) < 2 {
+		return nil, fmt.Errorf("truncated transfer")
+	}
+	in_zone := func(rr dns.RR) bool {
+		return dns.IsSubDomain(s.Zone, dns.CanonicalName(rr.Header().Name))
+	}
+
+	if _, incremental := response[1].(*dns.SOA); !incremental || s.soa == nil {
+		// full transfer: SOA, records..., SOA
+		records := []dns.RR{soa}
+		for _, rr := range response[1 : len(response)-1] {
+			if in_zone(rr) {
+				records = append(records, rr)
+			}
+		}
+		return records, nil
+	}
+
+	// incremental transfer: SOA, (old SOA, deleted..., new SOA, added...)..., SOA
+	records := []dns.RR{}
+	for _, rr := range s.published {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			records = append(records, rr)
+		}
+	}
+	// the old SOA of each delta starts its deletions, the new one its
+	// additions
+	adding := true
+	for _, rr := range response[1 : len(response)-1] {
+		if _, ok := rr.(*dns.SOA); ok {
+			adding = !adding
+			continue
+		}
+		if !in_zone(rr) {
+			continue
+		}
+		if adding {
+			records = append(records, rr)
+			continue
+		}
+		for i, record := range records {
+			if dns.IsDuplicate(rr, record) {
+				records = append(records[:i], records[i+1:]...)
+				break
+			}
+		}
+	}
+	return append(records, soa), nil
+}
+
+// Refreshes the zone from the first primary that responds
+func (s *Secondary) update(a *App) error {
+	var err error
+	for _, primary := range s.Primaries {
+		var response []dns.RR
+		response, err = s.transfer(primary)
+		if err != nil {
+			s.logger.Warn(
+				"transfer failed",
+				zap.String("primary", primary),
+				zap.Error(err),
+			)
+			continue
+		}
+		var records []dns.RR
+		records, err = s.apply(response)
+		if err != nil {
+			s.logger.Warn(
+				"invalid transfer",
+				zap.String("primary", primary),
+				zap.Error(err),
+			)
+			continue
+		}
+		s.refreshed = time.Now()
+		if records == nil {
+			s.logger.Debug("zone up-to-date", zap.Uint32("serial", s.soa.Serial))
+			return nil
+		}
+		err = a.replace(s.published, records)
+		if err != nil {
+			return err
+		}
+		s.published = records
+		s.soa = response[0].(*dns.SOA)
+		s.logger.Info(
+			"zone transferred",
+			zap.String("primary", primary),
+			zap.Uint32("serial", s.soa.Serial),
+			zap.Int("record_count", len(records)),
+		)
+		return nil
+	}
+	return err
+}
+
+// Keeps the zone up-to-date until the app is stopped
+func (s *Secondary) run(a *App) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.refresh:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-a.shutdown:
+			return
+		}
+
+		s.resolve_primaries()
+		err := s.update(a)
+
+		refresh, retry, expire := secondary_retry, secondary_retry, secondary_expire
+		if s.soa != nil {
+			refresh = time.Duration(s.soa.Refresh) * time.Second
+			retry = time.Duration(s.soa.Retry) * time.Second
+			expire = time.Duration(s.soa.Expire) * time.Second
+		}
+		// e.g. a refresh of 0 would transfer the zone continuously
+		if refresh < secondary_minimum {
+			refresh = secondary_minimum
+		}
+		if retry < secondary_minimum {
+			retry = secondary_minimum
+		}
+		if err == nil {
+			timer.Reset(refresh)
+			continue
+		}
+		timer.Reset(retry)
+		if s.soa != nil && time.Since(s.refreshed) > expire {
+			s.logger.Error("zone expired, no longer serving it", zap.Error(err))
+			err = a.replace(s.published, nil)
+			if err != nil {
+				s.logger.Error("failed to remove zone", zap.Error(err))
+				continue
+			}
+			s.published = nil
+			s.soa = nil
+		}
+	}
+}
+
+// Handles a NOTIFY message for a secondary zone, by triggering a refresh
+func (srv *Server) handle_notify(q query) {
+	m := new(dns.Msg)
+	m.SetReply(q.r)
+
+	zone := dns.CanonicalName(q.r.Question[0].Name)
+	secondary, ok := srv.secondaries[zone]
+	reason := "refreshing zone"
+	if !ok {
+		m.Rcode = dns.RcodeNotAuth
+		reason = "not a secondary zone"
+	} else if !secondary.is_primary(q.w.RemoteAddr()) {
+		m.Rcode = dns.RcodeRefused
+		reason = "not a primary"
+	} else {
+		m.Authoritative = true
+		select {
+		case secondary.refresh <- struct{}{}:
+		default:
+			// refresh already pending
+		}
+	}
+	srv.logger.Debug(
+		"answering notify",
+		zap.Stringer("address", q.w.RemoteAddr()),
+		zap.String("reason", reason),
+		zap.Object("response", LoggableDNSMsg{m}),
+	)
+	q.w.WriteMsg(m)
+}
+
+// Parses a "secondary" subdirective. Syntax:
+//
+//	secondary <zone> [<primary...>] {
+//	    [primary <address...>]
+//	    [key <name>]
+//	}
+func (s *Secondary) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	s.Zone = d.Val()
+	s.Primaries = append(s.Primaries, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "primary":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return d.ArgErr()
+			}
+			s.Primaries = append(s.Primaries, values...)
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Key = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized secondary subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/miekg/dns"
@@ -14,6 +16,17 @@ import (
 type query struct {
 	w dns.ResponseWriter
 	r *dns.Msg
+
+	// The handler waits for this before returning, since the connection
+	// belongs to the dns.Server again afterwards
+	pending *sync.WaitGroup
+}
+
+// Keeps the handler of the query waiting until the returned function is
+// called, for responses that are written outside of the main loop
+func (q query) hold() func() {
+	q.pending.Add(1)
+	return q.pending.Done
 }
 
 type key struct {
@@ -28,20 +41,67 @@ type Server struct {
 	// Statically configured records to serve
 	Records map[key][]dns.RR `json:"records,omitempty"`
 
+	// The zones the server is authoritative for
+	Zones []string `json:"zones,omitempty"`
+
+	// TSIG keys, by (canonical) name
+	Keys map[string]*TSIGKey `json:"keys,omitempty"`
+
+	// Outgoing zone transfers
+	Transfer *Transfer `json:"transfer,omitempty"`
+
+	// Forwarding of queries for names the server doesn't hold
+	Forward *Forward `json:"forward,omitempty"`
+
+	// Caching resolver for names the server doesn't hold
+	Resolver *Resolver `json:"resolver,omitempty"`
+
+	// Records served depending on the location of the client
+	GeoIP *GeoIP `json:"geoip,omitempty"`
+
+	// PTR records synthesized for the addresses in some prefixes
+	Reverse *Reverse `json:"reverse,omitempty"`
+
+	// How to handle the EDNS Client Subnet of queries: "use", "ignore" or
+	// "strip"
+	ClientSubnet string `json:"client_subnet,omitempty"`
+
+	// Only add glue for referrals to the additional section
+	MinimalResponses bool `json:"minimal_responses,omitempty"`
+
+	views             []*View                 // set by App.start()
+	trusted_resolvers []*net.IPNet            // set by App.start()
+	templates         []*Template             // set by App.start()
+	orders            map[key]*AnswerOrder    // set by App.start()
+	secondaries       map[string]*Secondary   // by zone, set by App.start()
+	signers           map[string]*zone_signer // by zone, set by App.start()
+
 	logger   *zap.Logger    // set by App.start()
 	ctx      *caddy.Context // set by App.start()
 	shutdown chan struct{}  // set by App.start()
+	stopped  chan struct{}  // set by App.start(), closed by main()
 	requests chan request   // set by App.start()
 
 	dns_server *dns.Server // set by start_stop_server()
+	tcp_server *dns.Server // set by start_stop_server(), if transfers enabled
 	queries    chan query  // set by start_stop_server()
 
+	journals map[string][]journal_entry // changes by zone, for IXFR
+	added    []dns.RR                   // since the last commit_changes()
+	deleted  []dns.RR                   // since the last commit_changes()
+
+	addresses          address_index // of the records, updated by track()
+	override_addresses address_index // of the records of views & GeoIP, set by App.start()
 }
 
 func rr_key(record dns.RR) key {
+	return key_of(record.Header().Name, record.Header().Rrtype)
+}
+
+func key_of(name string, rrtype uint16) key {
 	return key{
-		Type: dns.Type(record.Header().Rrtype),
-		Name: strings.ToLower(record.Header().Name),
+		Type: dns.Type(rrtype),
+		Name: strings.ToLower(name),
 	}
 }
 
@@ -54,6 +114,7 @@ func (srv *Server) insert_record(record dns.RR) {
 	} else {
 		srv.Records[key] = []dns.RR{record}
 	}
+	srv.track([]dns.RR{record}, nil)
 }
 
 func (srv *Server) delete_record(record dns.RR) bool {
@@ -67,6 +128,8 @@ func (srv *Server) delete_record(record dns.RR) bool {
 			// just rec != record does not seem to work, might be doing ptr eq
 			if rec.String() != as_string {
 				filtered = append(filtered, rec)
+			} else {
+				srv.track(nil, []dns.RR{rec})
 			}
 		}
 		if len(filtered) == 0 {
@@ -97,20 +160,60 @@ func (srv *Server) main() {
 		case r := <-srv.requests:
 			srv.handle_request(r)
 		case q := <-srv.queries:
-			srv.handle_query(q)
+			srv.handle_message(q)
+			q.pending.Done()
 		case <-srv.shutdown:
 			srv.logger.Debug("stopping main loop")
-			if srv.dns_server != nil {
-				srv.dns_server.Shutdown()
-			}
+			srv.stop_servers()
+			close(srv.stopped)
 			return
 		}
 	}
 }
 
+// Shuts the DNS servers down. The servers wait for their handlers, which
+// wait for the main loop, so queries are still answered meanwhile.
+//
+// The socket is shared with the server of a new configuration, whose reads
+// push the deadline that should unblock the read of the old server into the
+// future, so it is reset until the old server has stopped.
+func (srv *Server) stop_servers() error {
+	stopped := make(chan error, 1)
+	go func() {
+		var err error
+		if srv.dns_server != nil {
+			err = srv.dns_server.Shutdown()
+		}
+		if srv.tcp_server != nil {
+			if tcp_err := srv.tcp_server.Shutdown(); err == nil {
+				err = tcp_err
+			}
+		}
+		stopped <- err
+	}()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case q := <-srv.queries:
+			srv.handle_message(q)
+			q.pending.Done()
+		case <-ticker.C:
+			if srv.dns_server != nil && srv.dns_server.PacketConn != nil {
+				srv.dns_server.PacketConn.SetReadDeadline(time.Now())
+			}
+		case err := <-stopped:
+			return err
+		}
+	}
+}
+
 func (srv *Server) handle_request(r request) {
 	var count_field zap.Field
 	if r.append {
+		for _, record := range r.replaces {
+			srv.delete_record(record)
+		}
 		for _, record := range r.records {
 			srv.insert_record(record)
 		}
@@ -124,6 +227,7 @@ func (srv *Server) handle_request(r request) {
 		}
 		count_field = zap.Int("deleted_records", count)
 	}
+	srv.commit_changes()
 
 	srv.logger.Debug("handled", zap.Object("request", r), count_field)
 
@@ -134,11 +238,12 @@ func (srv *Server) start_stop_server() error {
 	if srv.queries == nil {
 		srv.queries = make(chan query)
 	}
-	if len(srv.Records) == 0 {
+	if len(srv.Records) == 0 && !srv.accepts_updates() && len(srv.secondaries) == 0 &&
+		len(srv.views) == 0 && len(srv.templates) == 0 && srv.GeoIP == nil && srv.Reverse == nil && srv.Forward == nil && srv.Resolver == nil {
 		if srv.dns_server != nil {
 			srv.logger.Debug("no more records to serve, shutting down server")
-			err := srv.dns_server.Shutdown()
-			srv.dns_server = nil
+			err := srv.stop_servers()
+			srv.dns_server, srv.tcp_server = nil, nil
 			return err
 		}
 		srv.logger.Debug("no records to serve")
@@ -157,11 +262,19 @@ func (srv *Server) start_stop_server() error {
 
 			// spawn the server
 			handler := make_proxy(srv.queries)
+			var secrets map[string]string
+			if len(srv.Keys) > 0 {
+				secrets = map[string]string{}
+				for name, key := range srv.Keys {
+					secrets[name] = key.Secret
+				}
+			}
 			server := &dns.Server{
-				PacketConn: conn,
-				Net:        "udp",
-				Handler:    handler,
-				TsigSecret: nil,
+				PacketConn:    conn,
+				Net:           "udp",
+				Handler:       handler,
+				TsigSecret:    secrets,
+				MsgAcceptFunc: accept_message,
 			}
 			srv.logger.Debug(
 				"starting server",
@@ -171,6 +284,29 @@ func (srv *Server) start_stop_server() error {
 
 			// store the server for shutdown later
 			srv.dns_server = server
+
+			if srv.Transfer != nil || len(srv.signers) > 0 ||
+				srv.Forward != nil || srv.Resolver != nil {
+				// zone transfers, and signed or forwarded responses that
+				// are too large for UDP, require TCP
+				listener, err := srv.listen_tcp()
+				if err != nil {
+					srv.logger.Error(
+						"failed to bind TCP",
+						zap.Stringer("address", srv.Address),
+						zap.Error(err),
+					)
+					return err
+				}
+				srv.tcp_server = &dns.Server{
+					Listener:      listener,
+					Net:           "tcp",
+					Handler:       handler,
+					TsigSecret:    secrets,
+					MsgAcceptFunc: accept_message,
+				}
+				go srv.serve(srv.tcp_server)
+			}
 			return nil
 		}
 		srv.logger.Debug(
@@ -194,12 +330,74 @@ func (srv *Server) bind() (net.PacketConn, error) {
 	return pkt_conn, nil
 }
 
+// Whether any key may update records, in which case the server has to listen
+// even if there are no records (yet).
+func (srv *Server) accepts_updates() bool {
+	for _, key := range srv.Keys {
+		if key.Update != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Like dns.DefaultMsgAcceptFunc, but also accepts dynamic updates, which
+// may have any number of records in each section.
+func accept_message(dh dns.Header) dns.MsgAcceptAction {
+	opcode := int(dh.Bits>>11) & 0xF
+	is_response := dh.Bits&(1<<15) != 0
+	if opcode == dns.OpcodeUpdate && !is_response {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func (srv *Server) handle_message(q query) {
+	switch q.r.Opcode {
+	case dns.OpcodeUpdate:
+		srv.handle_update(q)
+	case dns.OpcodeNotify:
+		srv.handle_notify(q)
+	default:
+		qtype := q.r.Question[0].Qtype
+		if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+			srv.handle_transfer(q)
+		} else {
+			srv.handle_query(q)
+		}
+	}
+}
+
+func (srv *Server) listen_tcp() (net.Listener, error) {
+	addr := srv.Address
+	addr.Network = "tcp"
+	ln, err := addr.Listen(srv.ctx, 0, net.ListenConfig{})
+	if err != nil {
+		return nil, err
+	}
+	listener, ok := ln.(net.Listener)
+	if !ok {
+		return nil, errors.New("invalid address")
+	}
+	srv.logger.Debug("bound to TCP socket", zap.Stringer("address", addr))
+	return listener, nil
+}
+
 func (srv *Server) handle_query(q query) {
 	// dns.DefaultMsgAcceptFunc already checks that the query is fairly
 	// reasonable.
 
 	m := new(dns.Msg)
 	m.SetReply(q.r)
+	if opt := q.r.IsEdns0(); opt != nil {
+		m.SetEdns0(edns_buffer_size, opt.Do())
+	}
+	if srv.Resolver != nil && srv.Resolver.allows(q) {
+		m.RecursionAvailable = true
+	}
 
 	reject_and_log := func(code int, reason string) {
 		m.Rcode = code
@@ -210,7 +408,7 @@ func (srv *Server) handle_query(q query) {
 			zap.String("reason", reason),
 			zap.Object("response", LoggableDNSMsg{m}),
 		)
-		q.w.WriteMsg(m)
+		write_response(q, m)
 	}
 
 	qstn := q.r.Question[0]
@@ -219,27 +417,205 @@ func (srv *Server) handle_query(q query) {
 		reject_and_log(dns.RcodeNotImplemented, "invalid class")
 		return
 	}
+	subnet, valid := srv.client_subnet(q)
+	if !valid {
+		reject_and_log(dns.RcodeFormatError, "invalid client subnet")
+		return
+	}
+	// views are access control, so they are never selected by the client
+	// subnet, which the sender chooses
+	view := srv.view_of(address_ip(q.w.RemoteAddr()))
+	defer srv.enter_view(view)()
+	defer srv.enter_location(client_ip(q, subnet), view)()
+
 	// queries may be wAcKY casE
 	// https://datatracker.ietf.org/doc/html/draft-vixie-dnsext-dns0x20-00
-	key := key{
-		Type: dns.Type(qstn.Qtype),
-		Name: strings.ToLower(qstn.Name),
+	// (names are compared in lowercase)
+	reason, err := srv.resolve(m, qstn.Name, qstn.Qtype, dnssec_ok(q.r))
+	if err != nil {
+		srv.logger.Error("failed to sign response", zap.Error(err))
+		reject_and_log(dns.RcodeServerFailure, "signing failed")
+		return
 	}
-	records, exists := srv.Records[key]
-	if !exists {
-		reject_and_log(dns.RcodeNameError, "no such record")
+	if reason != "" {
+		if reason == reason_not_held {
+			// the name isn't held locally
+			if srv.Resolver != nil && srv.Resolver.allows(q) {
+				release := q.hold()
+				go func() {
+					defer release()
+					srv.Resolver.resolve(q)
+				}()
+				return
+			}
+			if srv.Forward != nil {
+				release := q.hold()
+				strip := srv.ClientSubnet == subnet_strip
+				go func() {
+					defer release()
+					srv.Forward.forward(q, strip)
+				}()
+				return
+			}
+		}
+		reject_and_log(m.Rcode, reason)
 		return
 	}
-
-	m.Authoritative = true
-	m.Answer = records
+	err = srv.append_additional(m, dnssec_ok(q.r))
+	if err != nil {
+		srv.logger.Error("failed to sign response", zap.Error(err))
+		reject_and_log(dns.RcodeServerFailure, "signing failed")
+		return
+	}
+	srv.echo_subnet(m, subnet)
 
 	srv.logger.Debug(
 		"answering query",
 		zap.Stringer("address", q.w.RemoteAddr()),
 		zap.Object("response", LoggableDNSMsg{m}),
 	)
-	q.w.WriteMsg(m)
+	write_response(q, m)
+}
+
+// Appends the RRset to the section, along with its signatures if the
+// client asked for them (do) and the zone is signed. Records synthesized
+// from a wildcard are signed with the signatures of the wildcard.
+func (srv *Server) append_rrset(
+	section []dns.RR,
+	rrset []dns.RR,
+	zone string,
+	do bool,
+	wildcard string,
+) ([]dns.RR, error) {
+	if !do {
+		return append(section, rrset...), nil
+	}
+	if signer := srv.signers[zone]; signer != nil {
+		if wildcard == "" {
+			return signer.append_signed(section, rrset)
+		}
+		rrsigs, err := signer.sign_synthesized(rrset)
+		if err != nil {
+			return nil, err
+		}
+		section = append(section, rrset...)
+		return append(section, rrsigs...), nil
+	}
+	if !srv.is_presigned(zone) {
+		return append(section, rrset...), nil
+	}
+	if wildcard == "" {
+		return srv.append_presigned(section, rrset, zone), nil
+	}
+	section = append(section, rrset...)
+	for _, rr := range srv.covering_rrsigs(wildcard, rrset[0].Header().Rrtype, zone) {
+		rrsig := dns.Copy(rr)
+		rrsig.Header().Name = rrset[0].Header().Name
+		section = append(section, rrsig)
+	}
+	return section, nil
+}
+
+// Fills the authority section of a negative response (NXDOMAIN or NODATA)
+// with the SOA record of the zone, and the proof of non-existence if the
+// client asked for it (do) and the zone is signed.
+func (srv *Server) append_denial(m *dns.Msg, zone string, name string, do bool) error {
+	if do {
+		if signer := srv.signers[zone]; signer != nil {
+			return srv.deny_existence(m, signer, name)
+		}
+		if srv.is_presigned(zone) {
+			srv.presigned_denial(m, zone, name, m.Rcode == dns.RcodeSuccess)
+			return nil
+		}
+	}
+	if soa, ok := srv.soa(zone); ok {
+		m.Ns = append(m.Ns, soa)
+	}
+	return nil
+}
+
+// The names whose addresses belong in the additional section: the targets of
+// NS, MX & SRV answers and the name servers of referrals (glue). Unless
+// the answer is a referral, nothing is added for minimal responses.
+func (srv *Server) additional_names(m *dns.Msg) []string {
+	names := []string{}
+	add := func(name string) {
+		if name == "." {
+			// "no service" (RFC 2782, RFC 7505)
+			return
+		}
+		for _, existing := range names {
+			if strings.EqualFold(existing, name) {
+				return
+			}
+		}
+		names = append(names, name)
+	}
+	// only referrals have NS records in the authority section
+	for _, rr := range m.Ns {
+		if ns, ok := rr.(*dns.NS); ok {
+			add(ns.Ns)
+		}
+	}
+	if srv.MinimalResponses {
+		return names
+	}
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			add(rr.Ns)
+		case *dns.MX:
+			add(rr.Mx)
+		case *dns.SRV:
+			add(rr.Target)
+		}
+	}
+	return names
+}
+
+// Fills the additional section with the address records the server holds
+// for the targets of the answer (RFC 1034 section 4.3.2), along with their
+// signatures if the client asked for them (do)
+func (srv *Server) append_additional(m *dns.Msg, do bool) error {
+	for _, name := range srv.additional_names(m) {
+		zone, ok := srv.answer_zone(name, dns.TypeA)
+		if !ok {
+			zone = "."
+		}
+		// glue below a zone cut is not signed
+		_, glue := srv.find_delegation(strings.ToLower(name), zone)
+		for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			rrset := srv.Records[key_of(name, rrtype)]
+			if len(rrset) == 0 {
+				continue
+			}
+			extra, err := srv.append_rrset(m.Extra, rrset, zone, do && !glue, "")
+			if err != nil {
+				return err
+			}
+			m.Extra = extra
+		}
+	}
+	return nil
+}
+
+// The UDP payload size advertised in responses (see https://dnsflagday.net/2020/)
+const edns_buffer_size = 1232
+
+// Writes the response, truncated to the size the client accepts over UDP
+func write_response(q query, m *dns.Msg) error {
+	if q.w.RemoteAddr().Network() == "udp" {
+		size := dns.MinMsgSize
+		if opt := q.r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		if size > edns_buffer_size {
+			size = edns_buffer_size
+		}
+		m.Truncate(size)
+	}
+	return q.w.WriteMsg(m)
 }
 
 func (srv *Server) serve(server *dns.Server) {
@@ -251,10 +627,21 @@ func (srv *Server) serve(server *dns.Server) {
 	}
 }
 
-// dns.HandlerFunc that forwards every query into a channel
+// dns.HandlerFunc that forwards every query into a channel, and waits
+// until it has been answered
 func make_proxy(sink chan query) dns.HandlerFunc {
 	return func(w dns.ResponseWriter, r *dns.Msg) {
-		q := query{w, r}
+		if len(r.Question) == 1 && w.RemoteAddr().Network() == "tcp" {
+			qtype := r.Question[0].Qtype
+			if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+				// transfers may take longer than the idle timeout,
+				// the connection is closed once they are done
+				w.Hijack()
+			}
+		}
+		q := query{w, r, new(sync.WaitGroup)}
+		q.pending.Add(1)
 		sink <- q
+		q.pending.Wait()
 	}
 }
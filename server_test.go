@@ -1,15 +1,36 @@
 package stub
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unicode"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddytest"
 	"github.com/miekg/dns"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const dns_address string = "127.0.0.1:53535"
@@ -350,3 +371,2155 @@ func TestEmptyServer(t *testing.T) {
 	question.SetQuestion("sub123.example.com.", dns.TypeA)
 	check_fails(t, question, "refused")
 }
+
+const dns_caa_json string = `{
+	"admin": {
+		"listen": "localhost:2999"
+	},
+	"storage": {
+		"module": "file_system",
+		"root": "%s"
+	},
+	"apps": {
+		"dns": {
+			"address": "127.0.0.1:53535",
+			"zones": ["example.com"],
+			"caa": {}
+		},
+		"tls": {
+			"automation": {
+				"policies": [{
+					"issuers": [{
+						"module": "acme",
+						"ca": "https://acme-staging-v02.api.letsencrypt.org/directory",
+						"email": "caa@example.com",
+						"challenges": {
+							"dns": {
+								"provider": {
+									"name": "internal"
+								}
+							}
+						}
+					}]
+				}]
+			}
+		}
+	}
+}`
+
+func TestCAA(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(dns_caa_json, t.TempDir()), "json")
+
+	// no account has been registered yet
+	check_exists(
+		t,
+		"example.com. CAA 0 issue \"letsencrypt.org; validationmethods=dns-01\"",
+	)
+
+	// where certmagic stores the registration of the account
+	root := t.TempDir()
+	dir := filepath.Join(root, "acme", "acme-staging-v02.api.letsencrypt.org-directory", "users", "caa@example.com")
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(
+		filepath.Join(dir, "caa.json"),
+		[]byte(`{"status":"valid","location":"https://acme-staging-v02.api.letsencrypt.org/acme/acct/1234"}`),
+		0o600,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester.InitServer(fmt.Sprintf(dns_caa_json, root), "json")
+
+	in := query_dns(t, "example.com.", dns.TypeCAA)
+	expected := []string{
+		"example.com.\t3600\tIN\tCAA\t0 issue \"letsencrypt.org; accounturi=https://acme-staging-v02.api.letsencrypt.org/acme/acct/1234; validationmethods=dns-01\"",
+		"example.com.\t3600\tIN\tCAA\t0 issuewild \"letsencrypt.org; accounturi=https://acme-staging-v02.api.letsencrypt.org/acme/acct/1234; validationmethods=dns-01\"",
+	}
+	received := []string{}
+	for _, rr := range in.Answer {
+		received = append(received, rr.String())
+	}
+	sort.Strings(received)
+	if !reflect.DeepEqual(expected, received) {
+		t.Fatal("expected ", expected, ", got: ", received)
+	}
+}
+
+const dns_https string = `{
+	admin localhost:2999
+	debug
+	local_certs
+	skip_install_trust
+	dns 127.0.0.1:53535 {
+		zone example.com
+		https_records
+		address_records
+	}
+}
+
+https://www.example.com:9443 {
+	bind 127.0.0.1
+	respond "Hello"
+}
+`
+
+func TestSiteRecords(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_https, "caddyfile")
+
+	check_exists(
+		t,
+		"www.example.com. HTTPS 1 . alpn=h3,h2 port=9443 ipv4hint=127.0.0.1",
+	)
+	check_exists(t, "www.example.com. A 127.0.0.1")
+}
+
+const dns_placeholders string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "env.example.com. A {env.STUB_TEST_ADDRESS}"
+		record "lo.example.com. A {iface.lo.ipv4}"
+		record "data.example.com. TXT {name} {key:value}"
+	}
+}
+`
+
+func TestPlaceholders(t *testing.T) {
+	t.Setenv("STUB_TEST_ADDRESS", "192.0.2.42")
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_placeholders, "caddyfile")
+
+	check_exists(t, "env.example.com. A 192.0.2.42")
+	check_exists(t, "lo.example.com. A 127.0.0.1")
+	// braces that aren't known placeholders are kept
+	check_exists(t, "data.example.com. TXT {name} {key:value}")
+
+	// malformed interface placeholders are configuration errors
+	for _, placeholder := range []string{"{iface.}", "{iface.lo}", "{iface..ipv4}", "{iface.lo.ipv5}"} {
+		if _, err := expand_record("lo.example.com. A " + placeholder); err == nil {
+			t.Fatal("expected error for ", placeholder)
+		}
+	}
+}
+
+const dns_dyndns string = `{
+	admin localhost:2999
+	debug
+	http_port 9080
+	storage file_system {
+		root %s
+	}
+	dns 127.0.0.1:53535
+}
+
+http://localhost:9080 {
+	route /nic/update {
+		dyndns {
+			user router %[2]s *.dyn.example.com
+		}
+	}
+	route /v3/update {
+		dyndns {
+			user router %[2]s *.dyn.example.com
+		}
+	}
+}
+`
+
+func TestDynDNS(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf(
+		dns_dyndns,
+		t.TempDir(),
+		base64.StdEncoding.EncodeToString(hashed),
+	)
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(config, "caddyfile")
+
+	update_at := func(path string, password string, query string) *http.Request {
+		req, err := http.NewRequest(
+			"GET",
+			"http://localhost:9080"+path+"?"+query,
+			nil,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("router", password)
+		return req
+	}
+	update := func(password string, query string) *http.Request {
+		return update_at("/nic/update", password, query)
+	}
+
+	tester.AssertResponse(
+		update("hunter2", "hostname=office.dyn.example.com&myip=192.0.2.7"),
+		200,
+		"good 192.0.2.7\n",
+	)
+	check_exists(t, "office.dyn.example.com. 60 IN A 192.0.2.7")
+
+	tester.AssertResponse(
+		update("hunter2", "hostname=office.dyn.example.com&myip=192.0.2.7"),
+		200,
+		"nochg 192.0.2.7\n",
+	)
+	tester.AssertResponse(
+		update("hunter2", "hostname=example.com&myip=192.0.2.7"),
+		200,
+		"nohost\n",
+	)
+	tester.AssertResponse(
+		update("letmein", "hostname=office.dyn.example.com&myip=192.0.2.8"),
+		401,
+		"badauth\n",
+	)
+
+	// the handlers share the records, which are published once after a
+	// reload
+	tester.AssertResponse(
+		update_at("/v3/update", "hunter2", "hostname=office.dyn.example.com&myip=192.0.2.7"),
+		200,
+		"nochg 192.0.2.7\n",
+	)
+	tester.InitServer(config, "caddyfile")
+	in := query_dns(t, "office.dyn.example.com.", dns.TypeA)
+	if len(in.Answer) != 1 {
+		t.Fatal("expected a single record, got: ", in.Answer)
+	}
+	tester.AssertResponse(
+		update_at("/v3/update", "hunter2", "hostname=office.dyn.example.com&myip=192.0.2.8"),
+		200,
+		"good 192.0.2.8\n",
+	)
+	in = query_dns(t, "office.dyn.example.com.", dns.TypeA)
+	if len(in.Answer) != 1 {
+		t.Fatal("expected a single record, got: ", in.Answer)
+	}
+	check_exists(t, "office.dyn.example.com. 60 IN A 192.0.2.8")
+}
+
+const dns_tlsa string = `{
+	admin localhost:2999
+	debug
+	storage file_system {
+		root %s
+	}
+	dns 127.0.0.1:53535 {
+		tlsa {
+			service example.com 443
+			interval 100ms
+		}
+	}
+}
+`
+
+// Creates a certificate for the name, signed by the CA (or self-signed),
+// with a new key
+func create_certificate(t *testing.T, name string, ca *x509.Certificate, ca_key crypto.Signer, not_before time.Time) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crypto_rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(not_before.UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             not_before,
+		NotAfter:              not_before.Add(90 * 24 * time.Hour),
+		IsCA:                  ca == nil,
+		BasicConstraintsValid: true,
+	}
+	if ca == nil {
+		ca, ca_key = template, key
+	}
+	der, err := x509.CreateCertificate(crypto_rand.Reader, template, ca, key.Public(), ca_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// Stores the chain where certmagic keeps the certificate of the name
+func store_chain(t *testing.T, root string, name string, chain ...*x509.Certificate) {
+	dir := filepath.Join(root, "certificates", "acme-v02.api.letsencrypt.org-directory", name)
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte{}
+	for _, cert := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	err = os.WriteFile(filepath.Join(dir, name+".crt"), data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSA(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	// the storage has no certificates before the first one is obtained,
+	// which is published once it is
+	root := t.TempDir()
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(dns_tlsa, root), "caddyfile")
+
+	ca, ca_key := create_certificate(t, "Test CA", nil, nil, time.Now().Add(-time.Hour))
+	leaf, _ := create_certificate(t, "example.com", ca, ca_key, time.Now().Add(-time.Minute))
+	store_chain(t, root, "example.com", leaf, ca)
+	time.Sleep(300 * time.Millisecond)
+
+	record := func(usage int, cert *x509.Certificate) string {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return fmt.Sprintf("_443._tcp.example.com.\t3600\tIN\tTLSA\t%d 1 1 %s", usage, hex.EncodeToString(hash[:]))
+	}
+	check_records := func(expected ...string) {
+		in := query_dns(t, "_443._tcp.example.com.", dns.TypeTLSA)
+		received := []string{}
+		for _, rr := range in.Answer {
+			received = append(received, rr.String())
+		}
+		sort.Strings(expected)
+		sort.Strings(received)
+		if !reflect.DeepEqual(expected, received) {
+			t.Fatal("expected ", expected, ", got: ", received)
+		}
+	}
+
+	// the key of the certificate & of the issuer, which stays valid when
+	// the key of the certificate changes
+	check_records(record(3, leaf), record(2, ca))
+
+	// the hash of the previous key is retained after the key changed
+	renewed, _ := create_certificate(t, "example.com", ca, ca_key, time.Now())
+	store_chain(t, root, "example.com", renewed, ca)
+	time.Sleep(300 * time.Millisecond)
+	check_records(record(3, renewed), record(2, ca), record(3, leaf))
+}
+
+const dns_update string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		zone example.com
+		record "example.com. A 192.0.2.1"
+		record "www.example.com. A 192.0.2.3"
+		record "www.example.com. MX 10 example.com."
+		tsig_key update.example.com. c2VjcmV0IGtleSBmb3IgdGVzdGluZw== {
+			update_names *.example.com
+			update_types A TXT
+		}
+	}
+}
+`
+
+func send_update(t *testing.T, m *dns.Msg, sign bool) *dns.Msg {
+	c := new(dns.Client)
+	c.DialTimeout = 1 * time.Second
+	if sign {
+		c.TsigSecret = map[string]string{
+			"update.example.com.": "c2VjcmV0IGtleSBmb3IgdGVzdGluZw==",
+		}
+		m.SetTsig("update.example.com.", dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	in, _, err := c.Exchange(m, dns_address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+func TestUpdate(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_update, "caddyfile")
+
+	record, _ := dns.NewRR("host.example.com. 300 IN A 192.0.2.2")
+
+	unsigned := new(dns.Msg)
+	unsigned.SetUpdate("example.com.")
+	unsigned.Insert([]dns.RR{record})
+	if in := send_update(t, unsigned, false); in.Rcode != dns.RcodeRefused {
+		t.Fatal("unsigned update not refused: ", dns.RcodeToString[in.Rcode])
+	}
+
+	insert := new(dns.Msg)
+	insert.SetUpdate("example.com.")
+	insert.NameNotUsed([]dns.RR{record})
+	insert.Insert([]dns.RR{record})
+	if in := send_update(t, insert, true); in.Rcode != dns.RcodeSuccess {
+		t.Fatal("update failed: ", dns.RcodeToString[in.Rcode])
+	}
+	check_exists(t, "host.example.com. 300 IN A 192.0.2.2")
+
+	// the name is in use now
+	if in := send_update(t, insert.Copy(), true); in.Rcode != dns.RcodeYXDomain {
+		t.Fatal("prerequisite not checked: ", dns.RcodeToString[in.Rcode])
+	}
+
+	// the key has to be used with its algorithm
+	sha1 := new(dns.Msg)
+	sha1.SetUpdate("example.com.")
+	sha1.Insert([]dns.RR{record})
+	sha1.SetTsig("update.example.com.", dns.HmacSHA1, 300, time.Now().Unix())
+	c := &dns.Client{
+		Timeout:    time.Second,
+		TsigSecret: map[string]string{"update.example.com.": "c2VjcmV0IGtleSBmb3IgdGVzdGluZw=="},
+	}
+	if in, _, _ := c.Exchange(sha1, dns_address); in == nil || in.Rcode != dns.RcodeNotAuth {
+		t.Fatal("expected NOTAUTH for the wrong algorithm, got: ", in)
+	}
+
+	forbidden := new(dns.Msg)
+	forbidden.SetUpdate("example.com.")
+	mx, _ := dns.NewRR("host.example.com. 300 IN MX 10 example.com.")
+	forbidden.Insert([]dns.RR{mx})
+	if in := send_update(t, forbidden, true); in.Rcode != dns.RcodeRefused {
+		t.Fatal("type policy not enforced: ", dns.RcodeToString[in.Rcode])
+	}
+
+	remove := new(dns.Msg)
+	remove.SetUpdate("example.com.")
+	remove.Remove([]dns.RR{record})
+	if in := send_update(t, remove, true); in.Rcode != dns.RcodeSuccess {
+		t.Fatal("update failed: ", dns.RcodeToString[in.Rcode])
+	}
+	gone := new(dns.Msg)
+	gone.SetQuestion("host.example.com.", dns.TypeA)
+	check_errors(t, gone, dns.RcodeNameError)
+
+	// deleting all RRsets of a name only deletes the allowed types
+	remove_all := new(dns.Msg)
+	remove_all.SetUpdate("example.com.")
+	www, _ := dns.NewRR("www.example.com. 300 IN A 192.0.2.3")
+	remove_all.RemoveName([]dns.RR{www})
+	if in := send_update(t, remove_all, true); in.Rcode != dns.RcodeSuccess {
+		t.Fatal("update failed: ", dns.RcodeToString[in.Rcode])
+	}
+	check_exists(t, "www.example.com. 3600 IN MX 10 example.com.")
+	if in := query_dns(t, "www.example.com.", dns.TypeA); in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+		t.Fatal("expected A record to be deleted, got: ", in)
+	}
+}
+
+const dns_transfer string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "example.com. SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"
+		record "example.com. NS ns.example.com."
+		record "www.example.com. A 192.0.2.1"
+		tsig_key update.example.com. c2VjcmV0IGtleSBmb3IgdGVzdGluZw== {
+			update
+		}
+		transfer {
+			allow 127.0.0.1
+		}
+	}
+}
+`
+
+func transfer_in(t *testing.T, m *dns.Msg) []dns.RR {
+	tr := new(dns.Transfer)
+	tr.DialTimeout = 1 * time.Second
+	envelopes, err := tr.In(m, dns_address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []dns.RR{}
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			t.Fatal(envelope.Error)
+		}
+		records = append(records, envelope.RR...)
+	}
+	return records
+}
+
+func TestTransfer(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_transfer, "caddyfile")
+
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("example.com.")
+	records := transfer_in(t, axfr)
+	if len(records) != 4 {
+		t.Fatal("expected 4 records, got: ", records)
+	}
+	first, ok_first := records[0].(*dns.SOA)
+	last, ok_last := records[3].(*dns.SOA)
+	if !ok_first || !ok_last || first.Serial != 1 || last.Serial != 1 {
+		t.Fatal("transfer not enclosed in SOA records: ", records)
+	}
+
+	record, _ := dns.NewRR("mail.example.com. 300 IN A 192.0.2.2")
+	insert := new(dns.Msg)
+	insert.SetUpdate("example.com.")
+	insert.Insert([]dns.RR{record})
+	if in := send_update(t, insert, true); in.Rcode != dns.RcodeSuccess {
+		t.Fatal("update failed: ", dns.RcodeToString[in.Rcode])
+	}
+
+	ixfr := new(dns.Msg)
+	ixfr.SetIxfr("example.com.", 1, "ns.example.com.", "hostmaster.example.com.")
+	records = transfer_in(t, ixfr)
+	expected := []string{
+		"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 2 7200 3600 1209600 300",
+		"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+		"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 2 7200 3600 1209600 300",
+		"mail.example.com.\t300\tIN\tA\t192.0.2.2",
+		"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 2 7200 3600 1209600 300",
+	}
+	if len(records) != len(expected) {
+		t.Fatal("unexpected incremental transfer: ", records)
+	}
+	for i, record := range records {
+		if record.String() != expected[i] {
+			t.Fatalf("expected %s, got %s", expected[i], record.String())
+		}
+	}
+
+	// transfers require TCP
+	c := new(dns.Client)
+	c.DialTimeout = 1 * time.Second
+	in, _, err := c.Exchange(axfr, dns_address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Rcode != dns.RcodeRefused {
+		t.Fatal("AXFR over UDP not refused: ", dns.RcodeToString[in.Rcode])
+	}
+
+	// the key has to be used with its algorithm
+	tester.InitServer(strings.Replace(
+		dns_transfer,
+		"allow 127.0.0.1",
+		"allow 127.0.0.1\n\t\t\tkey update.example.com.",
+		1,
+	), "caddyfile")
+	c = &dns.Client{
+		Net:        "tcp",
+		Timeout:    time.Second,
+		TsigSecret: map[string]string{"update.example.com.": "c2VjcmV0IGtleSBmb3IgdGVzdGluZw=="},
+	}
+	for algorithm, expected := range map[string]int{
+		dns.HmacSHA256: dns.RcodeSuccess,
+		dns.HmacSHA1:   dns.RcodeNotAuth,
+	} {
+		signed := new(dns.Msg)
+		signed.SetAxfr("example.com.")
+		signed.SetTsig("update.example.com.", algorithm, 300, time.Now().Unix())
+		in, _, err := c.Exchange(signed, dns_address)
+		if err != nil && in == nil {
+			t.Fatal(err)
+		}
+		if in.Rcode != expected {
+			t.Fatal("expected ", dns.RcodeToString[expected], " for ", algorithm, ", got: ", in)
+		}
+	}
+}
+
+const dns_secondary string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		secondary example.org 127.0.0.1:53536
+		tsig_key update.example.com. c2VjcmV0IGtleSBmb3IgdGVzdGluZw== {
+			update_names *.example.org
+			update_types A
+		}
+	}
+}
+`
+
+// A minimal primary server for example.org, serving AXFR over TCP, and
+// IXFR with the given response (if any)
+func start_primary(t *testing.T, records []string, ixfr []string) *dns.Server {
+	parse := func(records []string) []dns.RR {
+		parsed := []dns.RR{}
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed = append(parsed, rr)
+		}
+		return parsed
+	}
+	zone, incremental := parse(records), parse(ixfr)
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		response := append(zone, zone[0])
+		if r.Question[0].Qtype == dns.TypeIXFR && len(incremental) > 0 {
+			response = incremental
+		}
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: response}
+		close(ch)
+		tr := new(dns.Transfer)
+		tr.Out(w, r, ch)
+		w.Close()
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Addr:              "127.0.0.1:53536",
+		Net:               "tcp",
+		Handler:           dns.HandlerFunc(handler),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ListenAndServe()
+	<-started
+	return server
+}
+
+func TestSecondary(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	primary := start_primary(t, []string{
+		"example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 1 7200 3600 1209600 300",
+		"example.org. 300 IN NS ns.example.org.",
+		"www.example.org. 300 IN A 192.0.2.10",
+		"www.example.net. 300 IN A 192.0.2.11",
+	}, []string{
+		// serial 2 deletes www & adds new
+		"example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 2 7200 3600 1209600 300",
+		"example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 1 7200 3600 1209600 300",
+		"www.example.org. 300 IN A 192.0.2.10",
+		"example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 2 7200 3600 1209600 300",
+		"new.example.org. 300 IN A 192.0.2.12",
+		"example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 2 7200 3600 1209600 300",
+	})
+	defer primary.Shutdown()
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_secondary, "caddyfile")
+
+	// the zone is transferred in the background
+	time.Sleep(200 * time.Millisecond)
+	check_exists(t, "www.example.org. 300 IN A 192.0.2.10")
+
+	// records outside of the zone are ignored
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.net.", dns.TypeA)
+	check_errors(t, m, dns.RcodeNameError)
+
+	// NOTIFY is only accepted for the zone & from the primary
+	notify := new(dns.Msg)
+	notify.SetNotify("example.net.")
+	check_errors(t, notify, dns.RcodeNotAuth)
+	notify.SetNotify("example.org.")
+	check_errors(t, notify, dns.RcodeSuccess)
+	c := new(dns.Client)
+	c.Dialer = &net.Dialer{
+		Timeout:   time.Second,
+		LocalAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.2")},
+	}
+	in, _, err := c.Exchange(notify, dns_address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Rcode != dns.RcodeRefused {
+		t.Fatal("expected REFUSED, got: ", in)
+	}
+
+	// updates would be overwritten by the next transfer
+	record, _ := dns.NewRR("host.example.org. 300 IN A 192.0.2.2")
+	update := new(dns.Msg)
+	update.SetUpdate("example.org.")
+	update.Insert([]dns.RR{record})
+	if in := send_update(t, update, true); in.Rcode != dns.RcodeRefused {
+		t.Fatal("expected REFUSED, got: ", in)
+	}
+	m.SetQuestion("host.example.org.", dns.TypeA)
+	check_errors(t, m, dns.RcodeNameError)
+
+	// the NOTIFY from the primary triggered an incremental transfer
+	check_exists(t, "example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 2 7200 3600 1209600 300")
+	check_exists(t, "new.example.org. 300 IN A 192.0.2.12")
+	m.SetQuestion("www.example.org.", dns.TypeA)
+	check_errors(t, m, dns.RcodeNameError)
+	if in := query_dns(t, "example.org.", dns.TypeNS); len(in.Answer) != 1 {
+		t.Fatal("expected a single NS record, got: ", in.Answer)
+	}
+}
+
+const dns_dnssec string = `{
+	admin localhost:2999
+	debug
+	storage file_system {
+		root %s
+	}
+	dns 127.0.0.1:53535 {
+		record "example.com. SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"
+		record "www.example.com. A 192.0.2.1"
+		record "sub.example.com. NS ns.sub.example.com."
+		record "ns.sub.example.com. A 192.0.2.53"
+		record "*.wild.example.com. TXT wildcard"
+		dnssec
+	}
+}
+`
+
+func query_dnssec(t *testing.T, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(4096, true)
+	c := new(dns.Client)
+	c.DialTimeout = 1 * time.Second
+	in, _, err := c.Exchange(m, dns_address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		t.Fatal("DNS error: ", dns.RcodeToString[in.Rcode])
+	}
+	return in
+}
+
+// Verifies the signature at the end of the section over the other records
+func check_signed(t *testing.T, section []dns.RR, keys []dns.RR) {
+	if len(section) < 2 {
+		t.Fatal("expected signed records, got: ", section)
+	}
+	rrsig, ok := section[len(section)-1].(*dns.RRSIG)
+	if !ok {
+		t.Fatal("expected RRSIG, got: ", section)
+	}
+	for _, rr := range keys {
+		key := rr.(*dns.DNSKEY)
+		if key.KeyTag() == rrsig.KeyTag {
+			if err := rrsig.Verify(key, section[:len(section)-1]); err != nil {
+				t.Fatal("invalid signature: ", err)
+			}
+			return
+		}
+	}
+	t.Fatal("no key for signature: ", rrsig)
+}
+
+func TestDNSSEC(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(dns_dnssec, t.TempDir()), "caddyfile")
+
+	keys := query_dnssec(t, "example.com.", dns.TypeDNSKEY).Answer
+	if len(keys) != 3 {
+		t.Fatal("expected 2 keys & a signature, got: ", keys)
+	}
+	check_signed(t, keys, keys)
+
+	answer := query_dnssec(t, "www.example.com.", dns.TypeA).Answer
+	check_signed(t, answer, keys)
+
+	// without the DO bit, responses are not signed
+	check_exists(t, "www.example.com. 3600 IN A 192.0.2.1")
+
+	denial := query_dnssec(t, "missing.example.com.", dns.TypeA)
+	if len(denial.Answer) != 0 || len(denial.Ns) != 4 {
+		t.Fatal("expected signed SOA & NSEC, got: ", denial.Ns)
+	}
+	check_signed(t, denial.Ns[:2], keys)
+	check_signed(t, denial.Ns[2:], keys)
+	nsec := denial.Ns[2].(*dns.NSEC)
+	if nsec.Hdr.Name != "missing.example.com." ||
+		fmt.Sprint(nsec.TypeBitMap) != fmt.Sprint([]uint16{dns.TypeRRSIG, dns.TypeNSEC}) {
+		t.Fatal("unexpected NSEC record: ", nsec)
+	}
+
+	// names answered from a wildcard have the types of the wildcard
+	denial = query_dnssec(t, "host.wild.example.com.", dns.TypeA)
+	if len(denial.Answer) != 0 || len(denial.Ns) != 4 {
+		t.Fatal("expected signed SOA & NSEC, got: ", denial.Ns)
+	}
+	check_signed(t, denial.Ns[2:], keys)
+	nsec = denial.Ns[2].(*dns.NSEC)
+	if nsec.Hdr.Name != "host.wild.example.com." ||
+		fmt.Sprint(nsec.TypeBitMap) != fmt.Sprint([]uint16{dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}) {
+		t.Fatal("unexpected NSEC record: ", nsec)
+	}
+
+	// the delegation is proven to be insecure, and the glue is not signed
+	referral := query_dnssec(t, "www.sub.example.com.", dns.TypeA)
+	if referral.Authoritative || len(referral.Ns) != 3 || len(referral.Extra) != 2 {
+		t.Fatal("expected referral with NSEC & glue, got: ", referral)
+	}
+	check_signed(t, referral.Ns[1:], keys)
+	nsec = referral.Ns[1].(*dns.NSEC)
+	if fmt.Sprint(nsec.TypeBitMap) != fmt.Sprint([]uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}) {
+		t.Fatal("unexpected NSEC record: ", nsec)
+	}
+}
+
+func TestKeyRollover(t *testing.T) {
+	d := DNSSEC{KSKLifetime: caddy.Duration(365 * 24 * time.Hour)}
+	if err := d.provision(); err != nil {
+		t.Fatal(err)
+	}
+	keys := &stored_keys{}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// returns the flags of the published & active keys after rolling
+	state := func(now time.Time) (published []uint16, active []uint16) {
+		if _, err := d.roll("example.com.", keys, now, 300); err != nil {
+			t.Fatal(err)
+		}
+		for i := range keys.Keys {
+			stored := &keys.Keys[i]
+			key, err := d.parse_key(*stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.is_published(now) {
+				published = append(published, key.dnskey.Flags)
+			}
+			if stored.is_active(now) {
+				active = append(active, key.dnskey.Flags)
+			}
+		}
+		return published, active
+	}
+	expect := func(now time.Time, published []uint16, active []uint16) {
+		p, a := state(now)
+		if fmt.Sprint(p) != fmt.Sprint(published) || fmt.Sprint(a) != fmt.Sprint(active) {
+			t.Fatalf(
+				"at %s: expected published %v & active %v, got %v & %v",
+				now, published, active, p, a,
+			)
+		}
+	}
+
+	expect(start, []uint16{257, 256}, []uint16{257, 256})
+	// the successor of the ZSK is pre-published 2 hours (TTL + propagation
+	// delay) before the end of its lifetime
+	zsk_rollover := start.Add(30*24*time.Hour - 2*time.Hour)
+	expect(zsk_rollover, []uint16{257, 256, 256}, []uint16{257, 256})
+	expect(zsk_rollover.Add(2*time.Hour), []uint16{257, 256, 256}, []uint16{257, 256})
+	// and the old ZSK is removed once its signatures have expired from caches
+	expect(zsk_rollover.Add(3*time.Hour+5*time.Minute), []uint16{257, 256}, []uint16{257, 256})
+
+	// the successor of the KSK signs right away
+	ksk_rollover := start.Add(365 * 24 * time.Hour)
+	_, a := state(ksk_rollover)
+	if strings.Count(fmt.Sprint(a), "257") != 2 {
+		t.Fatal("KSK not double signing: ", a)
+	}
+	// and the old KSK is removed after the parent has updated the DS record
+	_, a = state(ksk_rollover.Add(2*time.Hour + 48*time.Hour))
+	if strings.Count(fmt.Sprint(a), "257") != 1 {
+		t.Fatal("old KSK not removed: ", a)
+	}
+}
+
+const dns_presigned string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		zone_file %s
+	}
+}
+`
+
+// Writes a zone signed with a fresh key, with NSEC records, to a file
+func write_signed_zone(t *testing.T) (string, *dns.DNSKEY) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.net.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ED25519,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrsets := [][]string{
+		{"example.net. 3600 IN SOA ns.example.net. hostmaster.example.net. 1 7200 3600 1209600 300"},
+		{"example.net. 3600 IN NS ns.example.net."},
+		{key.String()},
+		{"example.net. 300 IN NSEC sub.example.net. NS SOA RRSIG NSEC DNSKEY"},
+		{"sub.example.net. 3600 IN DS 12345 15 2 " + strings.Repeat("ab", 32)},
+		{"sub.example.net. 300 IN NSEC www.example.net. NS DS RRSIG NSEC"},
+		{"www.example.net. 3600 IN A 192.0.2.20"},
+		{"www.example.net. 300 IN NSEC example.net. A RRSIG NSEC"},
+	}
+	zone := key.String() + "\n"
+	zone += "sub.example.net. 3600 IN NS ns.sub.example.net.\n"
+	for _, rrset := range rrsets {
+		records := []dns.RR{}
+		for _, record := range rrset {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rr)
+		}
+		rrsig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: records[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: records[0].Header().Ttl},
+			Algorithm:  key.Algorithm,
+			KeyTag:     key.KeyTag(),
+			SignerName: "example.net.",
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := rrsig.Sign(private.(crypto.Signer), records); err != nil {
+			t.Fatal(err)
+		}
+		for _, rr := range records {
+			if rr.Header().Rrtype != dns.TypeDNSKEY {
+				zone += rr.String() + "\n"
+			}
+		}
+		zone += rrsig.String() + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "example.net.zone")
+	if err := os.WriteFile(path, []byte(zone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+func TestPresigned(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	path, key := write_signed_zone(t)
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(dns_presigned, path), "caddyfile")
+
+	keys := []dns.RR{key}
+	check_signed(t, query_dnssec(t, "www.example.net.", dns.TypeA).Answer, keys)
+
+	// without the DO bit, there are no signatures
+	unsigned := query_dns(t, "www.example.net.", dns.TypeA)
+	if len(unsigned.Answer) != 1 {
+		t.Fatal("expected only the record, got: ", unsigned.Answer)
+	}
+
+	// the DS record is answered from the parent side of the cut
+	check_signed(t, query_dnssec(t, "sub.example.net.", dns.TypeDS).Answer, keys)
+
+	nodata := query_dnssec(t, "www.example.net.", dns.TypeAAAA)
+	if len(nodata.Ns) != 4 || nodata.Ns[2].(*dns.NSEC).Hdr.Name != "www.example.net." {
+		t.Fatal("expected signed SOA & NSEC, got: ", nodata.Ns)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("xyz.example.net.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	c := new(dns.Client)
+	nxdomain, _, err := c.Exchange(m, dns_address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nxdomain.Rcode != dns.RcodeNameError {
+		t.Fatal("expected NXDOMAIN, got: ", dns.RcodeToString[nxdomain.Rcode])
+	}
+	// the SOA, the NSEC covering the name & the one covering the wildcard
+	if len(nxdomain.Ns) != 6 {
+		t.Fatal("expected denial of name & wildcard, got: ", nxdomain.Ns)
+	}
+	for i := 0; i < 6; i += 2 {
+		check_signed(t, nxdomain.Ns[i:i+2], keys)
+	}
+}
+
+const dns_wildcard string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		zone example.com
+		record "*.preview.example.com. 300 A 192.0.2.5"
+		record "exists.preview.example.com. 300 TXT hello"
+		record "a.b.preview.example.com. 300 A 192.0.2.6"
+	}
+}
+`
+
+func TestWildcard(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_wildcard, "caddyfile")
+
+	check_exists(t, "branch-1.preview.example.com. 300 IN A 192.0.2.5")
+	check_exists(t, "deep.branch.preview.example.com. 300 IN A 192.0.2.5")
+
+	check_nodata := func(name string, qtype uint16) {
+		in := query_dns(t, name, qtype)
+		if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+			t.Fatal("expected NODATA for ", name, ", got: ", in)
+		}
+	}
+	// the wildcard doesn't match existing names
+	check_nodata("exists.preview.example.com.", dns.TypeA)
+	// or empty non-terminals
+	check_nodata("b.preview.example.com.", dns.TypeA)
+	// and only matches the types it has
+	check_nodata("branch-1.preview.example.com.", dns.TypeAAAA)
+
+	// the closest encloser has no wildcard
+	m := new(dns.Msg)
+	m.SetQuestion("x.b.preview.example.com.", dns.TypeA)
+	check_errors(t, m, dns.RcodeNameError)
+}
+
+const dns_cname string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		zone example.com
+		zone acme.example.net
+		record "_acme-challenge.example.com. 300 CNAME example.com.acme.example.net."
+		record "example.com.acme.example.net. 60 TXT token"
+		record "old.example.com. 300 DNAME new.example.com."
+		record "www.new.example.com. 300 A 192.0.2.7"
+		record "loop-1.example.com. 300 CNAME loop-2.example.com."
+		record "loop-2.example.com. 300 CNAME loop-1.example.com."
+		record "external.example.com. 300 CNAME example.org."
+	}
+}
+`
+
+func TestCNAME(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_cname, "caddyfile")
+
+	check_answer := func(in *dns.Msg, rcode int, expected ...string) {
+		if in.Rcode != rcode || len(in.Answer) != len(expected) {
+			t.Fatal("unexpected response: ", in)
+		}
+		for i, record := range expected {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in.Answer[i].String() != rr.String() {
+				t.Fatal("expected ", rr, ", got: ", in.Answer[i])
+			}
+		}
+	}
+
+	// the chain is followed into another zone
+	check_answer(
+		query_dns(t, "_acme-challenge.example.com.", dns.TypeTXT),
+		dns.RcodeSuccess,
+		"_acme-challenge.example.com. 300 IN CNAME example.com.acme.example.net.",
+		"example.com.acme.example.net. 60 IN TXT token",
+	)
+	// the CNAME itself is returned for CNAME queries
+	check_answer(
+		query_dns(t, "_acme-challenge.example.com.", dns.TypeCNAME),
+		dns.RcodeSuccess,
+		"_acme-challenge.example.com. 300 IN CNAME example.com.acme.example.net.",
+	)
+	// a CNAME is synthesized from the DNAME
+	check_answer(
+		query_dns(t, "www.old.example.com.", dns.TypeA),
+		dns.RcodeSuccess,
+		"old.example.com. 300 IN DNAME new.example.com.",
+		"www.old.example.com. 300 IN CNAME www.new.example.com.",
+		"www.new.example.com. 300 IN A 192.0.2.7",
+	)
+	// the target of the DNAME doesn't exist
+	in := query_dns(t, "missing.old.example.com.", dns.TypeA)
+	check_answer(
+		in,
+		dns.RcodeNameError,
+		"old.example.com. 300 IN DNAME new.example.com.",
+		"missing.old.example.com. 300 IN CNAME missing.new.example.com.",
+	)
+	if !in.Authoritative {
+		t.Fatal("expected authoritative NXDOMAIN, got: ", in)
+	}
+	// loops are answered with the records up to the loop
+	check_answer(
+		query_dns(t, "loop-1.example.com.", dns.TypeA),
+		dns.RcodeSuccess,
+		"loop-1.example.com. 300 IN CNAME loop-2.example.com.",
+		"loop-2.example.com. 300 IN CNAME loop-1.example.com.",
+	)
+	// targets that aren't served are left to the resolver
+	check_answer(
+		query_dns(t, "external.example.com.", dns.TypeA),
+		dns.RcodeSuccess,
+		"external.example.com. 300 IN CNAME example.org.",
+	)
+}
+
+const dns_additional string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		zone example.com
+		record "example.com. 300 NS ns1.example.com."
+		record "example.com. 300 MX 10 mx.example.com."
+		record "_caddy._tcp.example.com. 300 SRV 3 33 2999 srv.example.com."
+		record "ns1.example.com. 300 A 192.0.2.1"
+		record "ns1.example.com. 300 AAAA 2001:db8::1"
+		record "mx.example.com. 300 A 192.0.2.2"
+		record "srv.example.com. 300 AAAA 2001:db8::3"
+	}
+}
+`
+
+func TestAdditional(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_additional, "caddyfile")
+
+	check_additional := func(name string, qtype uint16, expected ...string) {
+		in := query_dns(t, name, qtype)
+		if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 1 {
+			t.Fatal("unexpected response: ", in)
+		}
+		if len(in.Extra) != len(expected) {
+			t.Fatal("expected ", len(expected), " additional records, got: ", in)
+		}
+		for i, record := range expected {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in.Extra[i].String() != rr.String() {
+				t.Fatal("expected ", rr, ", got: ", in.Extra[i])
+			}
+		}
+	}
+	check_additional(
+		"example.com.", dns.TypeNS,
+		"ns1.example.com. 300 IN A 192.0.2.1",
+		"ns1.example.com. 300 IN AAAA 2001:db8::1",
+	)
+	check_additional("example.com.", dns.TypeMX, "mx.example.com. 300 IN A 192.0.2.2")
+	check_additional("_caddy._tcp.example.com.", dns.TypeSRV, "srv.example.com. 300 IN AAAA 2001:db8::3")
+
+	minimal := strings.Replace(dns_additional, "zone example.com", "zone example.com\n\t\tminimal_responses", 1)
+	tester.InitServer(minimal, "caddyfile")
+	check_additional("example.com.", dns.TypeNS)
+	check_additional("example.com.", dns.TypeMX)
+}
+
+const dns_delegation string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "example.com. 300 SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"
+		record "team.example.com. 300 NS ns.team.example.com."
+		record "ns.team.example.com. 300 A 192.0.2.53"
+		record "occluded.team.example.com. 300 A 192.0.2.1"
+		minimal_responses
+	}
+}
+`
+
+func TestDelegation(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_delegation, "caddyfile")
+
+	for _, name := range []string{"team.example.com.", "occluded.team.example.com.", "missing.team.example.com."} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeNS} {
+			in := query_dns(t, name, qtype)
+			if in.Rcode != dns.RcodeSuccess || in.Authoritative || len(in.Answer) != 0 {
+				t.Fatal("expected referral, got: ", in)
+			}
+			if len(in.Ns) != 1 || in.Ns[0].String() != "team.example.com.\t300\tIN\tNS\tns.team.example.com." {
+				t.Fatal("expected NS records in authority section, got: ", in)
+			}
+			// glue is added for minimal responses as well
+			if len(in.Extra) != 1 || in.Extra[0].String() != "ns.team.example.com.\t300\tIN\tA\t192.0.2.53" {
+				t.Fatal("expected glue in additional section, got: ", in)
+			}
+		}
+	}
+
+	// the parent is authoritative for the DS records
+	in := query_dns(t, "team.example.com.", dns.TypeDS)
+	if in.Rcode != dns.RcodeSuccess || !in.Authoritative || len(in.Answer) != 0 {
+		t.Fatal("expected authoritative NODATA, got: ", in)
+	}
+}
+
+const dns_forward string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "_acme-challenge.example.com. 300 TXT local"
+		record "_acme-challenge.www.example.com. 300 TXT local"
+		forward %s {
+			timeout 200ms
+			attempts 2
+		}
+	}
+}
+`
+
+// A minimal backend that answers every query with the same address
+func start_backend(t *testing.T, network string) *dns.Server {
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		a, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.99")
+		m.Answer = []dns.RR{a}
+		w.WriteMsg(m)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Addr:              "127.0.0.1:53536",
+		Net:               network,
+		Handler:           dns.HandlerFunc(handler),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ListenAndServe()
+	<-started
+	return server
+}
+
+func TestForward(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	for _, network := range []string{"udp", "tcp"} {
+		backend := start_backend(t, network)
+		defer backend.Shutdown()
+	}
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(dns_forward, "127.0.0.1:53536"), "caddyfile")
+
+	// local names are answered locally
+	check_exists(t, "_acme-challenge.example.com. 300 IN TXT local")
+	// everything else by the backend, including the names above local
+	// records outside of the configured zones
+	check_exists(t, "www.example.com. 300 IN A 192.0.2.99")
+	check_exists(t, "example.com. 300 IN A 192.0.2.99")
+	check_exists(t, "_acme-challenge.www.example.com. 300 IN A 192.0.2.99")
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	c := &dns.Client{Net: "tcp", Timeout: time.Second}
+	in, _, err := c.Exchange(m, dns_address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].String() != "www.example.com.\t300\tIN\tA\t192.0.2.99" {
+		t.Fatal("expected forwarded answer over TCP, got: ", in)
+	}
+
+	// the backend doesn't respond
+	tester.InitServer(fmt.Sprintf(dns_forward, "127.0.0.1:53537"), "caddyfile")
+	check_errors(t, m, dns.RcodeServerFailure)
+}
+
+const dns_resolver string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "www.example.com. 300 A 192.0.2.1"
+		resolver 127.0.0.1:53536 {
+			allow 127.0.0.0/8
+			timeout 3s
+			attempts 1
+			serve_stale 1h
+		}
+	}
+}
+`
+
+// A minimal upstream resolver that counts the queries it answers, after
+// the delay. Names starting with "short" have a TTL of 1 second.
+func start_upstream(t *testing.T, count *int32, delay *int64) *dns.Server {
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(time.Duration(atomic.LoadInt64(delay)))
+		atomic.AddInt32(count, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.RecursionAvailable = true
+		ttl := "300"
+		if strings.HasPrefix(r.Question[0].Name, "short") {
+			ttl = "1"
+		}
+		a, _ := dns.NewRR(r.Question[0].Name + " " + ttl + " IN A 192.0.2.99")
+		m.Answer = []dns.RR{a}
+		w.WriteMsg(m)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Addr:              "127.0.0.1:53536",
+		Net:               "udp",
+		Handler:           dns.HandlerFunc(handler),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ListenAndServe()
+	<-started
+	return server
+}
+
+func TestResolver(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	var count int32
+	var delay int64
+	upstream := start_upstream(t, &count, &delay)
+	defer upstream.Shutdown()
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_resolver, "caddyfile")
+
+	resolve := func(name string) *dns.Msg {
+		in := query_dns(t, name, dns.TypeA)
+		if in.Rcode != dns.RcodeSuccess || !in.RecursionAvailable || len(in.Answer) != 1 {
+			t.Fatal("unexpected response: ", in)
+		}
+		return in
+	}
+
+	// local records override the upstream
+	if in := resolve("www.example.com."); in.Answer[0].String() != "www.example.com.\t300\tIN\tA\t192.0.2.1" {
+		t.Fatal("expected local answer, got: ", in)
+	}
+	if atomic.LoadInt32(&count) != 0 {
+		t.Fatal("local name was resolved by the upstream")
+	}
+
+	resolve("cached.example.net.")
+	resolve("cached.example.net.")
+	if atomic.LoadInt32(&count) != 1 {
+		t.Fatal("expected a single upstream query, got ", atomic.LoadInt32(&count))
+	}
+	// the names above local records are not held locally
+	if in := resolve("example.com."); in.Answer[0].String() != "example.com.\t300\tIN\tA\t192.0.2.99" {
+		t.Fatal("expected resolved answer, got: ", in)
+	}
+
+	// without recursion, only local records are served
+	m := new(dns.Msg)
+	m.SetQuestion("cached.example.net.", dns.TypeA)
+	m.RecursionDesired = false
+	check_errors(t, m, dns.RcodeNameError)
+
+	// expired responses are served while the upstream is slow, and
+	// refreshed in the background
+	resolve("short.slow.example.net.")
+	time.Sleep(1100 * time.Millisecond)
+	atomic.StoreInt64(&delay, int64(2500*time.Millisecond))
+	queried := atomic.LoadInt32(&count)
+	start := time.Now()
+	if in := resolve("short.slow.example.net."); in.Answer[0].Header().Ttl != 30 || time.Since(start) > 2*time.Second {
+		t.Fatal("expected stale answer, got: ", in)
+	}
+	atomic.StoreInt64(&delay, 0)
+	time.Sleep(1000 * time.Millisecond)
+	if in := resolve("short.slow.example.net."); in.Answer[0].Header().Ttl != 1 || atomic.LoadInt32(&count) != queried+1 {
+		t.Fatal("expected answer refreshed in the background, got: ", in)
+	}
+
+	// expired responses are served while the upstream is down
+	resolve("short.example.net.")
+	upstream.Shutdown()
+	time.Sleep(1100 * time.Millisecond)
+	if in := resolve("short.example.net."); in.Answer[0].Header().Ttl != 30 {
+		t.Fatal("expected stale answer, got: ", in)
+	}
+	m.SetQuestion("uncached.example.net.", dns.TypeA)
+	check_errors(t, m, dns.RcodeServerFailure)
+}
+
+const dns_views string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "www.example.com. 300 A 192.0.2.1"
+		record "_acme-challenge.example.com. 300 TXT token"
+		view internal {
+			network 127.0.0.2/32
+			record "www.example.com. 300 A 10.0.0.1"
+			record "intranet.example.com. 300 A 10.0.0.2"
+		}
+	}
+}
+`
+
+func TestViews(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_views, "caddyfile")
+
+	query_from := func(source string, name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		c := new(dns.Client)
+		c.Dialer = &net.Dialer{
+			Timeout:   time.Second,
+			LocalAddr: &net.UDPAddr{IP: net.ParseIP(source)},
+		}
+		in, _, err := c.Exchange(m, dns_address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in
+	}
+	check_answer := func(in *dns.Msg, expected string) {
+		if len(in.Answer) != 1 || in.Answer[0].String() != expected {
+			t.Fatal("expected ", expected, ", got: ", in)
+		}
+	}
+
+	// internal clients receive the records of the view
+	check_answer(query_from("127.0.0.2", "www.example.com.", dns.TypeA), "www.example.com.\t300\tIN\tA\t10.0.0.1")
+	check_answer(query_from("127.0.0.2", "intranet.example.com.", dns.TypeA), "intranet.example.com.\t300\tIN\tA\t10.0.0.2")
+	// and the other records
+	check_answer(query_from("127.0.0.2", "_acme-challenge.example.com.", dns.TypeTXT), "_acme-challenge.example.com.\t300\tIN\tTXT\t\"token\"")
+
+	// other clients don't
+	check_answer(query_from("127.0.0.1", "www.example.com.", dns.TypeA), "www.example.com.\t300\tIN\tA\t192.0.2.1")
+	if in := query_from("127.0.0.1", "intranet.example.com.", dns.TypeA); in.Rcode != dns.RcodeNameError {
+		t.Fatal("expected NXDOMAIN, got: ", in)
+	}
+}
+
+const dns_view_update string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "example.com. SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"
+		record "www.example.com. 300 A 192.0.2.1"
+		view internal {
+			network 127.0.0.2/32
+			record "intranet.example.com. 300 A 10.0.0.2"
+		}
+		tsig_key update.example.com. c2VjcmV0IGtleSBmb3IgdGVzdGluZw== {
+			update
+		}
+	}
+}
+`
+
+func TestViewUpdate(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_view_update, "caddyfile")
+
+	internal_serial := func() uint32 {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeSOA)
+		c := new(dns.Client)
+		c.Dialer = &net.Dialer{
+			Timeout:   time.Second,
+			LocalAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.2")},
+		}
+		in, _, err := c.Exchange(m, dns_address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(in.Answer) != 1 {
+			t.Fatal("expected the SOA record, got: ", in)
+		}
+		return in.Answer[0].(*dns.SOA).Serial
+	}
+
+	if serial := internal_serial(); serial != 1 {
+		t.Fatal("expected serial 1, got: ", serial)
+	}
+	record, _ := dns.NewRR("host.example.com. 300 IN A 192.0.2.2")
+	insert := new(dns.Msg)
+	insert.SetUpdate("example.com.")
+	insert.Insert([]dns.RR{record})
+	if in := send_update(t, insert, true); in.Rcode != dns.RcodeSuccess {
+		t.Fatal("update failed: ", dns.RcodeToString[in.Rcode])
+	}
+	// the view sees the new serial, not the one it merged before
+	if serial := internal_serial(); serial != 2 {
+		t.Fatal("expected serial 2, got: ", serial)
+	}
+}
+
+// Builds a minimal MaxMind database (IPv4 only, 24 bit records) that maps
+// single addresses to countries & continents
+func build_mmdb(locations map[string][2]string) []byte {
+	str := func(s string) []byte {
+		return append([]byte{2<<5 | byte(len(s))}, s...)
+	}
+	uint16_ := func(v uint16) []byte {
+		return []byte{5<<5 | 2, byte(v >> 8), byte(v)}
+	}
+	uint32_ := func(v uint32) []byte {
+		return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	map_ := func(entries ...[]byte) []byte {
+		encoded := []byte{7<<5 | byte(len(entries)/2)}
+		for _, entry := range entries {
+			encoded = append(encoded, entry...)
+		}
+		return encoded
+	}
+
+	// the search tree: the children of every node, or -1
+	nodes := [][2]int{{-1, -1}}
+	leaves := map[[2]int]int{} // (node, bit) -> offset in the data section
+	data := []byte{}
+	for ip, location := range locations {
+		offset := len(data)
+		data = append(data, map_(
+			str("country"), map_(str("iso_code"), str(location[0])),
+			str("continent"), map_(str("code"), str(location[1])),
+		)...)
+		address := net.ParseIP(ip).To4()
+		n := 0
+		for i := 0; i < 32; i++ {
+			bit := int(address[i/8]>>(7-i%8)) & 1
+			if i == 31 {
+				leaves[[2]int{n, bit}] = offset
+				break
+			}
+			if nodes[n][bit] == -1 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[n][bit] = len(nodes) - 1
+			}
+			n = nodes[n][bit]
+		}
+	}
+
+	db := []byte{}
+	count := len(nodes)
+	for n, children := range nodes {
+		for bit, child := range children {
+			value := count // no data
+			if child != -1 {
+				value = child
+			}
+			if offset, ok := leaves[[2]int{n, bit}]; ok {
+				value = count + 16 + offset
+			}
+			db = append(db, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	return append(db, map_(
+		str("node_count"), uint32_(uint32(count)),
+		str("record_size"), uint16_(24),
+		str("ip_version"), uint16_(4),
+		str("database_type"), str("Test-Country"),
+		str("binary_format_major_version"), uint16_(2),
+		str("binary_format_minor_version"), uint16_(0),
+	)...)
+}
+
+const dns_geoip string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "www.example.com. 300 A 192.0.2.1"
+		trusted_resolvers 127.0.0.1
+		geoip %s {
+			record "www.example.com. 300 A 192.0.2.10" {
+				country DE
+			}
+			record "www.example.com. 300 A 192.0.2.20" {
+				continent EU NA
+			}
+		}
+	}
+}
+`
+
+func TestGeoIP(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	database := filepath.Join(t.TempDir(), "test.mmdb")
+	err := os.WriteFile(database, build_mmdb(map[string][2]string{
+		"127.0.0.2": {"DE", "EU"},
+		"127.0.0.3": {"US", "NA"},
+		"127.0.0.4": {"JP", "AS"},
+	}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(dns_geoip, database), "caddyfile")
+
+	query_from := func(source string, subnet string) string {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		if subnet != "" {
+			m.SetEdns0(1232, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 32,
+				Address:       net.ParseIP(subnet),
+			})
+		}
+		c := new(dns.Client)
+		c.Dialer = &net.Dialer{
+			Timeout:   time.Second,
+			LocalAddr: &net.UDPAddr{IP: net.ParseIP(source)},
+		}
+		in, _, err := c.Exchange(m, dns_address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(in.Answer) != 1 {
+			t.Fatal("expected a single answer, got: ", in)
+		}
+		return in.Answer[0].(*dns.A).A.String()
+	}
+
+	for _, test := range []struct{ source, subnet, expected string }{
+		// the country takes precedence over the continent
+		{"127.0.0.2", "", "192.0.2.10"},
+		{"127.0.0.3", "", "192.0.2.20"},
+		// no matching record
+		{"127.0.0.4", "", "192.0.2.1"},
+		// not in the database
+		{"127.0.0.1", "", "192.0.2.1"},
+		// the client subnet is used if present
+		{"127.0.0.1", "127.0.0.2", "192.0.2.10"},
+		// but only if it comes from a trusted resolver
+		{"127.0.0.3", "127.0.0.2", "192.0.2.20"},
+	} {
+		if answer := query_from(test.source, test.subnet); answer != test.expected {
+			t.Fatal("expected ", test.expected, " for ", test, ", got: ", answer)
+		}
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	database := filepath.Join(t.TempDir(), "test.mmdb")
+	err := os.WriteFile(database, build_mmdb(map[string][2]string{
+		"192.0.2.0": {"DE", "EU"},
+	}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := strings.Replace(
+		fmt.Sprintf(dns_geoip, database),
+		`record "www.example.com. 300 A 192.0.2.1"`,
+		`record "www.example.com. 300 A 192.0.2.1"
+		record "static.example.com. 300 A 192.0.2.2"
+		view internal {
+			network 10.0.0.0/8
+			record "static.example.com. 300 A 10.0.0.1"
+		}`,
+		1,
+	)
+
+	query_subnet_from := func(source string, name string, address string, prefix uint8) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.SetEdns0(1232, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: prefix,
+			Address:       net.ParseIP(address).To4(),
+		})
+		c := new(dns.Client)
+		c.Dialer = &net.Dialer{
+			Timeout:   time.Second,
+			LocalAddr: &net.UDPAddr{IP: net.ParseIP(source)},
+		}
+		in, _, err := c.Exchange(m, dns_address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in
+	}
+	query_subnet := func(name string, address string, prefix uint8) *dns.Msg {
+		return query_subnet_from("127.0.0.1", name, address, prefix)
+	}
+	echoed := func(in *dns.Msg) *dns.EDNS0_SUBNET {
+		if opt := in.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+					return subnet
+				}
+			}
+		}
+		return nil
+	}
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(config, "caddyfile")
+
+	// the answer depends on the subnet
+	in := query_subnet("www.example.com.", "192.0.2.0", 24)
+	if in.Answer[0].(*dns.A).A.String() != "192.0.2.10" {
+		t.Fatal("expected answer for the subnet, got: ", in)
+	}
+	if subnet := echoed(in); subnet == nil || subnet.SourceNetmask != 24 || subnet.SourceScope != 24 {
+		t.Fatal("expected client subnet with scope 24, got: ", in)
+	}
+	// the answer is the same for all clients, and views are never selected
+	// by the client subnet
+	in = query_subnet("static.example.com.", "10.0.0.0", 8)
+	if in.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatal("expected answer outside of the view, got: ", in)
+	}
+	if subnet := echoed(in); subnet == nil || subnet.SourceScope != 0 {
+		t.Fatal("expected client subnet with scope 0, got: ", in)
+	}
+	// the client subnets of untrusted clients are ignored
+	in = query_subnet_from("127.0.0.2", "www.example.com.", "192.0.2.0", 24)
+	if in.Answer[0].(*dns.A).A.String() != "192.0.2.1" || echoed(in) != nil {
+		t.Fatal("expected client subnet of untrusted client to be ignored, got: ", in)
+	}
+	// bits set beyond the prefix
+	invalid := new(dns.Msg)
+	invalid.SetQuestion("www.example.com.", dns.TypeA)
+	invalid.SetEdns0(1232, false)
+	invalid.IsEdns0().Option = append(invalid.IsEdns0().Option, &dns.EDNS0_LOCAL{
+		Code: dns.EDNS0SUBNET,
+		Data: []byte{0, 1, 23, 0, 192, 0, 3},
+	})
+	check_errors(t, invalid, dns.RcodeFormatError)
+
+	// the subnet is ignored
+	tester.InitServer(strings.Replace(config, "geoip", "client_subnet ignore\n\t\tgeoip", 1), "caddyfile")
+	in = query_subnet("www.example.com.", "192.0.2.0", 24)
+	if in.Answer[0].(*dns.A).A.String() != "192.0.2.1" || echoed(in) != nil {
+		t.Fatal("expected client subnet to be ignored, got: ", in)
+	}
+}
+
+const dns_health string = `{
+	admin localhost:2999
+	debug
+	http_port 9080
+	dns 127.0.0.1:53535 {
+		health_checks {
+			interval 100ms
+			timeout 1s
+			record "www.example.com. 300 A 192.0.2.1" {
+				tcp %[1]s
+			}
+			record "www.example.com. 300 A 192.0.2.2" {
+				tcp %[2]s
+			}
+			record "api.example.com. 300 A 192.0.2.3" {
+				http %[3]s
+			}
+			record "api.example.com. 300 A 192.0.2.4" {
+				fallback
+			}
+			record "app.example.com. 300 A 192.0.2.5" {
+				upstream %[2]s
+			}
+			record "app.example.com. 300 A 192.0.2.6" {
+				tcp %[1]s
+			}
+			record "db.example.com. 300 A 192.0.2.7" {
+				tcp %[2]s
+			}
+			record "db.example.com. 300 A 192.0.2.8" {
+				tcp %[2]s
+			}
+		}
+	}
+}
+
+http://localhost:9080 {
+	reverse_proxy %[2]s {
+		health_uri /health
+		health_interval 100ms
+	}
+}
+`
+
+func TestHealth(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	healthy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer healthy.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(
+		dns_health,
+		healthy.Addr().String(),
+		closed.Addr().String(),
+		failing.URL,
+	), "caddyfile")
+
+	answers := func(name string) string {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		in, err := dns.Exchange(m, dns_address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses := []string{}
+		for _, rr := range in.Answer {
+			addresses = append(addresses, rr.(*dns.A).A.String())
+		}
+		sort.Strings(addresses)
+		return strings.Join(addresses, " ")
+	}
+
+	for _, test := range []struct{ name, expected string }{
+		// unhealthy records are dropped
+		{"www.example.com.", "192.0.2.1"},
+		// the fallback is served if no other record is healthy
+		{"api.example.com.", "192.0.2.4"},
+		// the reverse proxy considers its upstream unhealthy
+		{"app.example.com.", "192.0.2.6"},
+		// all records are served if none is healthy
+		{"db.example.com.", "192.0.2.7 192.0.2.8"},
+	} {
+		answer := ""
+		for i := 0; i < 50; i++ {
+			answer = answers(test.name)
+			if answer == test.expected {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if answer != test.expected {
+			t.Fatal("expected ", test.expected, " for ", test.name, ", got: ", answer)
+		}
+	}
+}
+
+const dns_order string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "rr.example.com. 300 A 192.0.2.1"
+		record "rr.example.com. 300 A 192.0.2.2"
+		record "rr.example.com. 300 A 192.0.2.3"
+		record "random.example.com. 300 A 192.0.2.1"
+		record "random.example.com. 300 A 192.0.2.2"
+		record "weighted.example.com. 300 A 192.0.2.1"
+		record "weighted.example.com. 300 A 192.0.2.2"
+		record "weighted.example.com. 300 A 192.0.2.3"
+		answer_order rr.example.com. A round_robin
+		answer_order random.example.com A random
+		answer_order weighted.example.com. A weighted {
+			weight 192.0.2.1 3
+			weight 192.0.2.3 0
+			count 1
+		}
+	}
+}
+`
+
+func TestAnswerOrder(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_order, "caddyfile")
+
+	answers := func(name string) string {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		in, err := dns.Exchange(m, dns_address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses := []string{}
+		for _, rr := range in.Answer {
+			addresses = append(addresses, rr.(*dns.A).A.String())
+		}
+		return strings.Join(addresses, " ")
+	}
+
+	// the records are rotated for every answer
+	first := answers("rr.example.com.")
+	rotations := []string{
+		"192.0.2.1 192.0.2.2 192.0.2.3",
+		"192.0.2.2 192.0.2.3 192.0.2.1",
+		"192.0.2.3 192.0.2.1 192.0.2.2",
+	}
+	start := -1
+	for i, rotation := range rotations {
+		if rotation == first {
+			start = i
+		}
+	}
+	if start < 0 {
+		t.Fatal("unexpected order: ", first)
+	}
+	for i := 1; i < 4; i++ {
+		expected := rotations[(start+i)%len(rotations)]
+		if answer := answers("rr.example.com."); answer != expected {
+			t.Fatal("expected ", expected, ", got: ", answer)
+		}
+	}
+
+	// both orders occur, with all records
+	seen := map[string]bool{}
+	for i := 0; i < 100 && len(seen) < 2; i++ {
+		answer := answers("random.example.com.")
+		if answer != "192.0.2.1 192.0.2.2" && answer != "192.0.2.2 192.0.2.1" {
+			t.Fatal("unexpected answer: ", answer)
+		}
+		seen[answer] = true
+	}
+	if len(seen) != 2 {
+		t.Fatal("expected both orders, got: ", seen)
+	}
+
+	// a single record is selected by weight, and never one of weight 0
+	counts := map[string]int{}
+	for i := 0; i < 200; i++ {
+		counts[answers("weighted.example.com.")] += 1
+	}
+	if len(counts) != 2 || counts["192.0.2.1"] <= counts["192.0.2.2"] || counts["192.0.2.2"] == 0 {
+		t.Fatal("unexpected distribution: ", counts)
+	}
+}
+
+const dns_template string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		zone example.com.
+		record "example.com. 300 SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"
+		record "ip-192-0-2-99.dev.example.com. 300 A 198.51.100.1"
+		template ip-(\d+)-(\d+)-(\d+)-(\d+)\.dev\.example\.com "{name} 60 A {match.1}.{match.2}.{match.3}.{match.4}"
+		template .+\.pr-(?P<pr>\d+)\.preview\.example\.com {
+			record "{name} 60 CNAME pr-{match.pr}.lb.example.net."
+		}
+	}
+}
+`
+
+func TestTemplate(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_template, "caddyfile")
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		in, err := dns.Exchange(m, dns_address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in
+	}
+	check_answer := func(in *dns.Msg, expected ...string) {
+		if len(in.Answer) != len(expected) {
+			t.Fatal("expected ", expected, ", got: ", in)
+		}
+		for i, rr := range in.Answer {
+			if rr.String() != expected[i] {
+				t.Fatal("expected ", expected[i], ", got: ", in)
+			}
+		}
+	}
+
+	// the address is taken from the name
+	check_answer(query("IP-10-0-0-5.dev.example.com.", dns.TypeA), "IP-10-0-0-5.dev.example.com.\t60\tIN\tA\t10.0.0.5")
+	// records of the name take precedence
+	check_answer(query("ip-192-0-2-99.dev.example.com.", dns.TypeA), "ip-192-0-2-99.dev.example.com.\t300\tIN\tA\t198.51.100.1")
+	// the name exists, but has no records of the type
+	in := query("ip-10-0-0-5.dev.example.com.", dns.TypeAAAA)
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 || !in.Authoritative {
+		t.Fatal("expected NODATA, got: ", in)
+	}
+	// names that aren't addresses don't exist
+	for _, name := range []string{"ip-10-0-0-999.dev.example.com.", "www.dev.example.com."} {
+		if in := query(name, dns.TypeA); in.Rcode != dns.RcodeNameError {
+			t.Fatal("expected NXDOMAIN for ", name, ", got: ", in)
+		}
+	}
+
+	// named captures
+	check_answer(
+		query("app.pr-123.preview.example.com.", dns.TypeA),
+		"app.pr-123.preview.example.com.\t60\tIN\tCNAME\tpr-123.lb.example.net.",
+	)
+}
+
+const dns_reverse string = `{
+	admin localhost:2999
+	debug
+	dns 127.0.0.1:53535 {
+		record "www.example.com. 300 A 192.0.2.10"
+		record "www.example.com. 300 AAAA 2001:db8::10"
+		record "mail.example.com. 600 A 192.0.2.10"
+		record "*.example.com. 300 A 192.0.2.11"
+		record "20.2.0.192.in-addr.arpa. 300 PTR static.example.com."
+		reverse 192.0.2.0/24 {
+			prefix 2001:db8::/48
+			fallback ip-{ip.dashed}.example.com
+		}
+		view internal {
+			network 127.0.0.2/32
+			record "www.example.com. 300 A 192.0.2.40"
+		}
+		zone example.com
+		tsig_key update.example.com. c2VjcmV0IGtleSBmb3IgdGVzdGluZw== {
+			update
+		}
+	}
+}
+`
+
+func TestReverse(t *testing.T) {
+	caddytest.Default.TestRequestTimeout = 1 * time.Second
+	caddytest.Default.LoadRequestTimeout = 1 * time.Second
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(dns_reverse, "caddyfile")
+
+	query_from := func(source string, address string, qtype uint16) *dns.Msg {
+		name, err := dns.ReverseAddr(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		c := new(dns.Client)
+		c.Dialer = &net.Dialer{
+			Timeout:   time.Second,
+			LocalAddr: &net.UDPAddr{IP: net.ParseIP(source)},
+		}
+		in, _, err := c.Exchange(m, dns_address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in
+	}
+	query := func(address string, qtype uint16) *dns.Msg {
+		return query_from("127.0.0.1", address, qtype)
+	}
+	check_answer_from := func(source string, address string, expected ...string) {
+		in := query_from(source, address, dns.TypePTR)
+		answer := []string{}
+		for _, rr := range in.Answer {
+			answer = append(answer, fmt.Sprint(rr.Header().Ttl, " ", rr.(*dns.PTR).Ptr))
+		}
+		if !reflect.DeepEqual(answer, expected) {
+			t.Fatal("expected ", expected, " for ", address, ", got: ", in)
+		}
+	}
+	check_answer := func(address string, expected ...string) {
+		check_answer_from("127.0.0.1", address, expected...)
+	}
+
+	// the names of all address records, but not of wildcards
+	check_answer("192.0.2.10", "300 mail.example.com.", "300 www.example.com.")
+	check_answer("2001:db8::10", "300 www.example.com.")
+	// configured records take precedence
+	check_answer("192.0.2.20", "300 static.example.com.")
+	// the fallback for other addresses
+	check_answer("192.0.2.30", "3600 ip-192-0-2-30.example.com.")
+	check_answer("2001:db8::1", "3600 ip-2001-db8--1.example.com.")
+
+	// the names exist, but only have PTR records
+	if in := query("192.0.2.10", dns.TypeTXT); in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+		t.Fatal("expected NODATA, got: ", in)
+	}
+	// addresses outside of the prefixes have no records
+	if in := query("198.51.100.1", dns.TypePTR); in.Rcode != dns.RcodeNameError {
+		t.Fatal("expected NXDOMAIN, got: ", in)
+	}
+
+	// the names of the prefixes & the networks within them exist, but
+	// those above the prefixes don't
+	for name, rcode := range map[string]int{
+		"2.0.192.in-addr.arpa.":                             dns.RcodeSuccess,
+		"0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.":                 dns.RcodeSuccess,
+		"0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": dns.RcodeSuccess,
+		"8.b.d.0.1.0.0.2.ip6.arpa.":                         dns.RcodeNameError,
+	} {
+		in := query_dns(t, name, dns.TypePTR)
+		if in.Rcode != rcode || len(in.Answer) != 0 {
+			t.Fatal("expected ", dns.RcodeToString[rcode], " for ", name, ", got: ", in)
+		}
+	}
+
+	// the records of the view replace those of the server
+	check_answer_from("127.0.0.2", "192.0.2.10", "600 mail.example.com.")
+	check_answer_from("127.0.0.2", "192.0.2.40", "300 www.example.com.")
+	check_answer("192.0.2.40", "3600 ip-192-0-2-40.example.com.")
+
+	// updated records are pointed to, deleted ones aren't anymore
+	record, _ := dns.NewRR("host.example.com. 60 IN A 192.0.2.30")
+	insert := new(dns.Msg)
+	insert.SetUpdate("example.com.")
+	insert.Insert([]dns.RR{record})
+	if in := send_update(t, insert, true); in.Rcode != dns.RcodeSuccess {
+		t.Fatal("update failed: ", dns.RcodeToString[in.Rcode])
+	}
+	check_answer("192.0.2.30", "60 host.example.com.")
+	remove := new(dns.Msg)
+	remove.SetUpdate("example.com.")
+	remove.Remove([]dns.RR{record})
+	if in := send_update(t, remove, true); in.Rcode != dns.RcodeSuccess {
+		t.Fatal("update failed: ", dns.RcodeToString[in.Rcode])
+	}
+	check_answer("192.0.2.30", "3600 ip-192-0-2-30.example.com.")
+}
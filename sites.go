@@ -0,0 +1,84 @@
+package stub
+
+import (
+	"net"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/miekg/dns"
+)
+
+// A site served by Caddy's "http" app, as far as DNS is concerned
+type http_site struct {
+	host      string
+	https     bool
+	ports     []uint16
+	ips       []net.IP // only the specific addresses the server listens on
+	protocols []string
+}
+
+// Collects the hostnames of all sites served by the "http" app, by server.
+// Hostnames with wildcards or placeholders are skipped.
+func http_sites(app *caddyhttp.App) []http_site {
+	sites := []http_site{}
+	for _, srv := range app.Servers {
+		ports := []uint16{}
+		ips := []net.IP{}
+		for _, listen := range srv.Listen {
+			addr, err := caddy.ParseNetworkAddress(listen)
+			if err != nil || addr.IsUnixNetwork() {
+				continue
+			}
+			for port := addr.StartPort; port <= addr.EndPort; port++ {
+				ports = append(ports, uint16(port))
+			}
+			if ip := net.ParseIP(addr.Host); ip != nil && !ip.IsUnspecified() {
+				ips = append(ips, ip)
+			}
+		}
+
+		seen := map[string]bool{}
+		for _, route := range srv.Routes {
+			for _, set := range route.MatcherSets {
+				for _, matcher := range set {
+					hosts, ok := matcher.(*caddyhttp.MatchHost)
+					if !ok {
+						continue
+					}
+					for _, host := range *hosts {
+						if strings.ContainsAny(host, "*{}") {
+							continue
+						}
+						host = dns.CanonicalName(host)
+						if seen[host] {
+							continue
+						}
+						seen[host] = true
+						sites = append(sites, http_site{
+							host:      host,
+							https:     len(srv.TLSConnPolicies) > 0,
+							ports:     ports,
+							ips:       ips,
+							protocols: srv.Protocols,
+						})
+					}
+				}
+			}
+		}
+	}
+	return sites
+}
+
+// Returns the zone that contains name, if any
+func zone_of(name string, zones []string) (string, bool) {
+	longest := ""
+	found := false
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, name) && len(zone) >= len(longest) {
+			longest = zone
+			found = true
+		}
+	}
+	return longest, found
+}
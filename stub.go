@@ -14,14 +14,17 @@ type request struct {
 	append    bool
 	zone      string
 	records   []dns.RR
+	replaces  []dns.RR // deleted before appending records, atomically
 	responder chan error
 }
 
 func init() {
 	caddy.RegisterModule(App{})
 	caddy.RegisterModule(Provider{})
+	caddy.RegisterModule(DynDNS{})
 
 	httpcaddyfile.RegisterGlobalOption("dns", parseApp)
+	httpcaddyfile.RegisterHandlerDirective("dyndns", parseDynDNS)
 }
 
 func record_to_rr(zone string, record libdns.Record) (dns.RR, error) {
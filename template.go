@@ -0,0 +1,127 @@
+package stub
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Records that are synthesized for names matching a pattern, e.g. A records
+// for names that contain an address (like nip.io), or CNAME records for
+// preview environments. Names that have records of their own don't match.
+type Template struct {
+	// A regular expression (RE2 syntax) that has to match the whole name,
+	// without the trailing dot & in lowercase
+	Pattern string `json:"pattern"`
+
+	// The records for matching names. Their owner is always the queried
+	// name. Besides Caddy's global placeholders, the records can contain
+	// {name} for the queried name, {match.0} for the whole match,
+	// {match.<n>} for the n-th capture group, and {match.<name>} for the
+	// named capture groups of the pattern.
+	Records []string `json:"records"`
+
+	regexp *regexp.Regexp // set in provision()
+}
+
+func (t *Template) provision() error {
+	if len(t.Records) == 0 {
+		return fmt.Errorf("template '%s' requires records", t.Pattern)
+	}
+	re, err := regexp.Compile("^(?:" + t.Pattern + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid template pattern '%s': %v", t.Pattern, err)
+	}
+	t.regexp = re
+	return nil
+}
+
+// Renders the records of the template for the name, if it matches
+func (t *Template) render(name string) ([]dns.RR, bool, error) {
+	matches := t.regexp.FindStringSubmatch(strings.ToLower(strings.TrimSuffix(name, ".")))
+	if matches == nil {
+		return nil, false, nil
+	}
+	repl := caddy.NewReplacer()
+	repl.Set("name", name)
+	for i, match := range matches {
+		repl.Set("match."+strconv.Itoa(i), match)
+		if group := t.regexp.SubexpNames()[i]; group != "" {
+			repl.Set("match."+group, match)
+		}
+	}
+	records := []dns.RR{}
+	for _, template := range t.Records {
+		expanded, err := repl.ReplaceOrErr(template, true, true)
+		if err != nil {
+			return nil, true, err
+		}
+		rr, err := dns.NewRR(expanded)
+		if err != nil {
+			return nil, true, err
+		}
+		if rr == nil {
+			continue
+		}
+		rr.Header().Name = name
+		records = append(records, rr)
+	}
+	return records, true, nil
+}
+
+// The records synthesized for the name by the first template that matches
+// it, if any. A name whose records can't be rendered (e.g. because a
+// capture isn't a valid address) doesn't exist.
+func (srv *Server) template_records(name string) ([]dns.RR, bool) {
+	for _, template := range srv.templates {
+		records, matched, err := template.render(name)
+		if !matched {
+			continue
+		}
+		if err != nil {
+			srv.logger.Debug(
+				"failed to render template",
+				zap.String("name", name),
+				zap.String("pattern", template.Pattern),
+				zap.Error(err),
+			)
+			return nil, false
+		}
+		return records, true
+	}
+	return nil, false
+}
+
+// Parses a "template" subdirective. Syntax:
+//
+//	template <pattern> [<record...>] {
+//	    [record "<record>"]
+//	}
+func (t *Template) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	t.Pattern = d.Val()
+	t.Records = append(t.Records, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "record":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Records = append(t.Records, d.Val())
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized template subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package stub
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Automatically generated TLSA records (DANE) for the certificates managed
+// by Caddy's "tls" app.
+//
+// The records use the "SPKI" selector, so they stay valid when a certificate
+// is renewed with the same key (which is what certmagic does by default).
+// The hash of the next key can't be published before a key change, since
+// certmagic only generates the key when it obtains the certificate.
+// Instead, a record for the issuing CA ("DANE-TA") is published as well,
+// which stays valid when the key changes. The hash of a previous key stays
+// published for the retention period.
+type TLSA struct {
+	// The services to publish TLSA records for
+	Services []TLSAService `json:"services,omitempty"`
+
+	// Don't publish the "2 1 1" (DANE-TA) record for the issuing CA, only
+	// the one for the key of the certificate. Clients will then reject
+	// the certificate after its key changed until they see the new record.
+	ExcludeIssuer bool `json:"exclude_issuer,omitempty"`
+
+	// How long to keep publishing the hash of a key that is no longer in
+	// use. Defaults to 48 hours.
+	Retain caddy.Duration `json:"retain,omitempty"`
+
+	// How often to check for new certificates, in addition to checking
+	// whenever the "tls" app has obtained one. Defaults to 1 hour.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// The TTL of the generated records, in seconds. Defaults to 3600.
+	TTL uint32 `json:"ttl,omitempty"`
+
+	storage certmagic.Storage // set in provision()
+	logger  *zap.Logger       // set in provision()
+	refresh chan struct{}     // set in provision()
+
+	published []dns.RR             // owned by run()
+	retired   map[string]time.Time // owned by run()
+}
+
+// A service using a certificate managed by Caddy
+type TLSAService struct {
+	// The name of the certificate (and the host the service runs on)
+	Name string `json:"name"`
+
+	// The port of the service
+	Port uint16 `json:"port"`
+
+	// The transport protocol of the service. Defaults to "tcp".
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// The owner name of the TLSA records for the service
+func (s TLSAService) owner() string {
+	protocol := s.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	return "_" + strconv.Itoa(int(s.Port)) + "._" + protocol + "." + dns.Fqdn(s.Name)
+}
+
+// Handles "cert_obtained" events by triggering a refresh of the records
+// that depend on the certificates (or the ACME account used to obtain them).
+// Implements caddyevents.Handler.
+type refresh_handler struct{ refresh chan struct{} }
+
+func (h refresh_handler) Handle(context.Context, caddyevents.Event) error {
+	select {
+	case h.refresh <- struct{}{}:
+	default:
+		// refresh already pending
+	}
+	return nil
+}
+
+func (t *TLSA) provision(ctx caddy.Context) error {
+	t.storage = ctx.Storage()
+	t.logger = ctx.Logger().Named("tlsa")
+	t.refresh = make(chan struct{}, 1)
+	t.retired = map[string]time.Time{}
+	if t.Retain == 0 {
+		t.Retain = caddy.Duration(48 * time.Hour)
+	}
+	if t.Interval == 0 {
+		t.Interval = caddy.Duration(time.Hour)
+	}
+	if t.TTL == 0 {
+		t.TTL = 3600
+	}
+
+	app, err := ctx.App("events")
+	if err != nil {
+		return err
+	}
+	return app.(*caddyevents.App).On("cert_obtained", refresh_handler{t.refresh})
+}
+
+// Loads the most recent certificate chain for name from storage, regardless
+// of the issuer.
+func (t *TLSA) load_chain(ctx context.Context, name string) ([]*x509.Certificate, error) {
+	issuers, err := t.storage.List(ctx, "certificates", false)
+	if errors.Is(err, fs.ErrNotExist) {
+		// no certificates obtained yet
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	candidates := []string{name}
+	if labels := dns.SplitDomainName(name); len(labels) > 1 {
+		candidates = append(candidates, "*."+strings.Join(labels[1:], "."))
+	}
+
+	var newest []*x509.Certificate
+	for _, issuer := range issuers {
+		for _, candidate := range candidates {
+			key := certmagic.StorageKeys.SiteCert(path.Base(issuer), candidate)
+			data, err := t.storage.Load(ctx, key)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			chain := []*x509.Certificate{}
+			for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, err
+				}
+				chain = append(chain, cert)
+			}
+			if len(chain) == 0 {
+				continue
+			}
+			if newest == nil || chain[0].NotBefore.After(newest[0].NotBefore) {
+				newest = chain
+			}
+		}
+	}
+	return newest, nil
+}
+
+// Generates the TLSA records for the certificates currently in storage
+func (t *TLSA) current(ctx context.Context) ([]dns.RR, error) {
+	records := []dns.RR{}
+	for _, service := range t.Services {
+		chain, err := t.load_chain(ctx, strings.TrimSuffix(service.Name, "."))
+		if err != nil {
+			return nil, err
+		}
+		if chain == nil {
+			t.logger.Debug("no certificate", zap.String("name", service.Name))
+			continue
+		}
+		hdr := dns.RR_Header{
+			Name:   service.owner(),
+			Rrtype: dns.TypeTLSA,
+			Class:  dns.ClassINET,
+			Ttl:    t.TTL,
+		}
+
+		leaf := &dns.TLSA{Hdr: hdr}
+		err = leaf.Sign(3, 1, 1, chain[0])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, leaf)
+
+		if !t.ExcludeIssuer && len(chain) > 1 {
+			issuer := &dns.TLSA{Hdr: hdr}
+			err = issuer.Sign(2, 1, 1, chain[1])
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, issuer)
+		}
+	}
+	return records, nil
+}
+
+// Determines the records to publish: the current ones, plus the ones that
+// were retired recently enough.
+func (t *TLSA) update(ctx context.Context) ([]dns.RR, error) {
+	current, err := t.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	is_current := map[string]bool{}
+	for _, record := range current {
+		is_current[record.String()] = true
+		delete(t.retired, record.String())
+	}
+
+	records := current
+	for _, record := range t.published {
+		as_string := record.String()
+		if is_current[as_string] {
+			continue
+		}
+		since, retired := t.retired[as_string]
+		if !retired {
+			t.logger.Info("key changed, retiring record", zap.String("record", as_string))
+			since = now
+			t.retired[as_string] = now
+		}
+		if now.Sub(since) < time.Duration(t.Retain) {
+			records = append(records, record)
+		} else {
+			delete(t.retired, as_string)
+		}
+	}
+	return records, nil
+}
+
+// Keeps the published records up-to-date until the app is stopped
+func (t *TLSA) run(a *App) {
+	ticker := time.NewTicker(time.Duration(t.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.refresh:
+		case <-a.shutdown:
+			return
+		}
+		records, err := t.update(a.ctx)
+		if err != nil {
+			t.logger.Error("failed to update records", zap.Error(err))
+			continue
+		}
+		if same_records(records, t.published) {
+			continue
+		}
+		err = a.replace(t.published, records)
+		if err != nil {
+			t.logger.Error("failed to publish records", zap.Error(err))
+			continue
+		}
+		t.published = records
+	}
+}
+
+// Parses the block of the "tlsa" subdirective
+func (t *TLSA) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "service":
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			port, err := strconv.ParseUint(args[1], 10, 16)
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			service := TLSAService{Name: args[0], Port: uint16(port)}
+			if len(args) == 3 {
+				service.Protocol = args[2]
+			}
+			t.Services = append(t.Services, service)
+		case "exclude_issuer":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ExcludeIssuer = true
+		case "retain", "interval":
+			option := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			if option == "retain" {
+				t.Retain = caddy.Duration(duration)
+			} else {
+				t.Interval = caddy.Duration(duration)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			t.TTL = uint32(ttl)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized TLSA subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,479 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Outgoing zone transfers (AXFR & IXFR), over TCP, to secondary servers.
+// Transfers are only possible for zones with a SOA record.
+type Transfer struct {
+	// The zones that may be transferred. Defaults to all zones.
+	Zones []string `json:"zones,omitempty"`
+
+	// The networks (in CIDR notation) or addresses that may request
+	// transfers. If empty, transfers are allowed from any address, but
+	// only if they are signed with one of the keys.
+	Allow []string `json:"allow,omitempty"`
+
+	// The TSIG keys transfers have to be signed with (any one of).
+	// If empty, transfers don't need to be signed.
+	Keys []string `json:"keys,omitempty"`
+
+	// The addresses of secondary servers to send NOTIFY messages to
+	// whenever a zone changes
+	Notify []string `json:"notify,omitempty"`
+
+	networks []*net.IPNet // set in provision()
+}
+
+// The number of changes to keep per zone for IXFR
+const journal_length = 100
+
+// A change to a zone, for IXFR
+type journal_entry struct {
+	from    *dns.SOA
+	to      *dns.SOA
+	deleted []dns.RR
+	added   []dns.RR
+}
+
+func (t *Transfer) provision() error {
+	if len(t.Allow) == 0 && len(t.Keys) == 0 {
+		return fmt.Errorf("transfers have to be restricted by address or key")
+	}
+	networks, err := parse_networks(t.Allow)
+	if err != nil {
+		return err
+	}
+	t.networks = networks
+	for i, key := range t.Keys {
+		t.Keys[i] = dns.CanonicalName(key)
+	}
+	for i, zone := range t.Zones {
+		t.Zones[i] = dns.CanonicalName(zone)
+	}
+	for i, addr := range t.Notify {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			t.Notify[i] = net.JoinHostPort(addr, "53")
+		}
+	}
+	return nil
+}
+
+// Parses networks in CIDR notation, or single addresses
+func parse_networks(allowed []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, allowed := range allowed {
+		if !strings.Contains(allowed, "/") {
+			if strings.Contains(allowed, ":") {
+				allowed += "/128"
+			} else {
+				allowed += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(allowed)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// The IP address of a client, or nil
+func address_ip(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Whether the address is in one of the networks
+func networks_contain(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the zone may be transferred
+func (t *Transfer) includes(zone string) bool {
+	if len(t.Zones) == 0 {
+		return true
+	}
+	for _, z := range t.Zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the address & TSIG key of a transfer request. Returns the rcode
+// to refuse it with, if it isn't permitted.
+func (t *Transfer) permits(q query, keys map[string]*TSIGKey) (int, string) {
+	if len(t.networks) > 0 && !networks_contain(t.networks, address_ip(q.w.RemoteAddr())) {
+		return dns.RcodeRefused, "address not allowed"
+	}
+	if len(t.Keys) > 0 {
+		tsig := q.r.IsTsig()
+		if tsig == nil {
+			return dns.RcodeRefused, "transfer not signed"
+		}
+		if err := q.w.TsigStatus(); err != nil {
+			return dns.RcodeRefused, "TSIG verification failed: " + err.Error()
+		}
+		if !tsig_algorithm_matches(tsig, keys) {
+			return dns.RcodeNotAuth, "wrong TSIG algorithm"
+		}
+		for _, key := range t.Keys {
+			if strings.EqualFold(key, tsig.Hdr.Name) {
+				return dns.RcodeSuccess, ""
+			}
+		}
+		return dns.RcodeRefused, "key not allowed"
+	}
+	return dns.RcodeSuccess, ""
+}
+
+// The SOA record of a zone, if it has one
+func (srv *Server) soa(zone string) (*dns.SOA, bool) {
+	for _, record := range srv.Records[key_of(zone, dns.TypeSOA)] {
+		if soa, ok := record.(*dns.SOA); ok {
+			return soa, true
+		}
+	}
+	return nil, false
+}
+
+// Sets the serial of SOA records without one to the current time, so that
+// secondaries pick up the changes after the configuration is reloaded.
+func (srv *Server) init_serials() {
+	for _, zone := range srv.Zones {
+		soa, ok := srv.soa(zone)
+		if ok && soa.Serial == 0 {
+			soa.Serial = uint32(time.Now().Unix())
+		}
+	}
+}
+
+// Records a change to the records, to be committed to the journal. The
+// records of the views are merged again when they are next served, and the
+// addresses are indexed for reverse records.
+func (srv *Server) track(added []dns.RR, deleted []dns.RR) {
+	srv.added = append(srv.added, added...)
+	srv.deleted = append(srv.deleted, deleted...)
+	for _, rr := range added {
+		srv.addresses.add(rr)
+	}
+	for _, rr := range deleted {
+		srv.addresses.remove(rr)
+	}
+	srv.invalidate_merged()
+}
+
+// Drops the records the views and GeoIP merged with the global ones, so
+// that they are merged again with the current records.
+func (srv *Server) invalidate_merged() {
+	for _, view := range srv.views {
+		view.merged = nil
+	}
+	if srv.GeoIP != nil {
+		srv.GeoIP.merged = nil
+	}
+}
+
+// Forgets the tracked changes, i.e. when loading the initial records
+func (srv *Server) reset_changes() {
+	srv.added = nil
+	srv.deleted = nil
+}
+
+// Increments the serials of all zones that were changed, records the
+// changes in their journal and notifies the secondaries.
+func (srv *Server) commit_changes() {
+	type change struct{ added, deleted []dns.RR }
+	changes := map[string]*change{}
+	get := func(name string) *change {
+		zone, ok := zone_of(name, srv.Zones)
+		if !ok {
+			return nil
+		}
+		if changes[zone] == nil {
+			changes[zone] = &change{}
+		}
+		return changes[zone]
+	}
+	for _, rr := range srv.added {
+		if c := get(rr.Header().Name); c != nil {
+			c.added = append(c.added, rr)
+		}
+	}
+	for _, rr := range srv.deleted {
+		if c := get(rr.Header().Name); c != nil {
+			c.deleted = append(c.deleted, rr)
+		}
+	}
+	srv.reset_changes()
+
+	for zone, c := range changes {
+		soa, ok := srv.soa(zone)
+		if !ok {
+			continue
+		}
+		if _, secondary := srv.secondaries[zone]; secondary {
+			// the serial is managed by the primary
+			srv.notify(zone, soa)
+			continue
+		}
+		next := dns.Copy(soa).(*dns.SOA)
+		next.Serial += 1
+		srv.Records[key_of(zone, dns.TypeSOA)] = []dns.RR{next}
+		// not tracked as a change, so the merged records would keep the old serial
+		srv.invalidate_merged()
+
+		srv.journals[zone] = append(srv.journals[zone], journal_entry{
+			from:    soa,
+			to:      next,
+			deleted: c.deleted,
+			added:   c.added,
+		})
+		if len(srv.journals[zone]) > journal_length {
+			srv.journals[zone] = srv.journals[zone][1:]
+		}
+		srv.logger.Debug(
+			"zone changed",
+			zap.String("zone", zone),
+			zap.Uint32("serial", next.Serial),
+		)
+		srv.notify(zone, next)
+	}
+}
+
+// Sends NOTIFY messages to the secondaries, in the background
+func (srv *Server) notify(zone string, soa *dns.SOA) {
+	if srv.Transfer == nil || !srv.Transfer.includes(zone) {
+		return
+	}
+	for _, secondary := range srv.Transfer.Notify {
+		go func(secondary string) {
+			m := new(dns.Msg)
+			m.SetNotify(zone)
+			m.Answer = []dns.RR{soa}
+			c := new(dns.Client)
+			c.Timeout = 2 * time.Second
+			var err error
+			for attempt := 0; attempt < 3; attempt++ {
+				_, _, err = c.Exchange(m, secondary)
+				if err == nil {
+					srv.logger.Debug(
+						"notified secondary",
+						zap.String("zone", zone),
+						zap.String("secondary", secondary),
+					)
+					return
+				}
+			}
+			srv.logger.Warn(
+				"failed to notify secondary",
+				zap.String("zone", zone),
+				zap.String("secondary", secondary),
+				zap.Error(err),
+			)
+		}(secondary)
+	}
+}
+
+// Notifies the secondaries of all zones, i.e. after the configuration has
+// been (re-)loaded.
+func (srv *Server) notify_all() {
+	for _, zone := range srv.Zones {
+		if soa, ok := srv.soa(zone); ok {
+			srv.notify(zone, soa)
+		}
+	}
+}
+
+// All records of a zone, for AXFR, excluding the SOA
+func (srv *Server) zone_records(zone string) []dns.RR {
+	records := []dns.RR{}
+	for key, rrset := range srv.Records {
+		if key.Type == dns.Type(dns.TypeSOA) && key.Name == zone {
+			continue
+		}
+		if z, ok := zone_of(key.Name, srv.Zones); ok && z == zone {
+			records = append(records, rrset...)
+		}
+	}
+	return records
+}
+
+// The IXFR response sequence from the given serial to the current one, if
+// the journal covers it.
+func (srv *Server) incremental(zone string, serial uint32) ([]dns.RR, bool) {
+	journal := srv.journals[zone]
+	for i, entry := range journal {
+		if entry.from.Serial != serial {
+			continue
+		}
+		records := []dns.RR{}
+		for _, entry := range journal[i:] {
+			records = append(records, entry.from)
+			records = append(records, entry.deleted...)
+			records = append(records, entry.to)
+			records = append(records, entry.added...)
+		}
+		return records, true
+	}
+	return nil, false
+}
+
+// Handles AXFR & IXFR requests
+func (srv *Server) handle_transfer(q query) {
+	m := new(dns.Msg)
+	m.SetReply(q.r)
+	qstn := q.r.Question[0]
+	is_tcp := q.w.RemoteAddr().Network() == "tcp"
+
+	refuse := func(code int, reason string) {
+		m.Rcode = code
+		srv.logger.Debug(
+			"refusing transfer",
+			zap.Stringer("address", q.w.RemoteAddr()),
+			zap.String("reason", reason),
+			zap.Object("response", LoggableDNSMsg{m}),
+		)
+		q.w.WriteMsg(m)
+		if is_tcp {
+			q.w.Close()
+		}
+	}
+
+	if srv.Transfer == nil {
+		refuse(dns.RcodeRefused, "transfers not enabled")
+		return
+	}
+	zone := dns.CanonicalName(qstn.Name)
+	soa, ok := srv.soa(zone)
+	if !ok || !srv.Transfer.includes(zone) {
+		refuse(dns.RcodeNotAuth, "not a transferable zone")
+		return
+	}
+	if code, reason := srv.Transfer.permits(q, srv.Keys); code != dns.RcodeSuccess {
+		refuse(code, reason)
+		return
+	}
+
+	var records []dns.RR
+	if qstn.Qtype == dns.TypeIXFR {
+		var client *dns.SOA
+		if len(q.r.Ns) == 1 {
+			client, _ = q.r.Ns[0].(*dns.SOA)
+		}
+		if client == nil {
+			refuse(dns.RcodeFormatError, "IXFR without SOA")
+			return
+		}
+		if client.Serial == soa.Serial {
+			records = []dns.RR{}
+		} else if incremental, ok := srv.incremental(zone, client.Serial); ok && is_tcp {
+			records = incremental
+		} else if !is_tcp {
+			// the client will retry over TCP
+			records = []dns.RR{}
+		}
+	} else if !is_tcp {
+		refuse(dns.RcodeRefused, "AXFR requires TCP")
+		return
+	}
+	if records == nil {
+		// fall back to AXFR
+		records = srv.zone_records(zone)
+		records = append(records, soa)
+	} else if len(records) > 0 {
+		records = append(records, soa)
+	}
+	records = append([]dns.RR{soa}, records...)
+
+	srv.logger.Debug(
+		"transferring zone",
+		zap.Stringer("address", q.w.RemoteAddr()),
+		zap.String("zone", zone),
+		zap.String("type", dns.TypeToString[qstn.Qtype]),
+		zap.Int("record_count", len(records)),
+	)
+	// don't block the main loop while sending the records
+	release := q.hold()
+	go func() {
+		defer release()
+		srv.send_transfer(q, records, is_tcp)
+	}()
+}
+
+func (srv *Server) send_transfer(q query, records []dns.RR, is_tcp bool) {
+	ch := make(chan *dns.Envelope)
+	done := make(chan error)
+	tr := new(dns.Transfer)
+	go func() {
+		done <- tr.Out(q.w, q.r, ch)
+	}()
+	defer func() {
+		if is_tcp {
+			q.w.Close()
+		}
+	}()
+	for len(records) > 0 {
+		n := len(records)
+		if n > 100 {
+			n = 100
+		}
+		select {
+		case ch <- &dns.Envelope{RR: records[:n]}:
+			records = records[n:]
+		case err := <-done:
+			srv.logger.Warn("transfer failed", zap.Error(err))
+			return
+		}
+	}
+	close(ch)
+	if err := <-done; err != nil {
+		srv.logger.Warn("transfer failed", zap.Error(err))
+	}
+}
+
+// Parses the block of the "transfer" subdirective
+func (t *Transfer) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		values := d.RemainingArgs()
+		if len(values) == 0 {
+			return d.ArgErr()
+		}
+		switch option {
+		case "zone":
+			t.Zones = append(t.Zones, values...)
+		case "allow":
+			t.Allow = append(t.Allow, values...)
+		case "key":
+			t.Keys = append(t.Keys, values...)
+		case "notify":
+			t.Notify = append(t.Notify, values...)
+		default:
+			return d.Errf("unrecognized transfer subdirective '%s'", option)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package stub
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// A TSIG key, for authenticating dynamic updates (RFC 2136)
+type TSIGKey struct {
+	// The name of the key
+	Name string `json:"name"`
+
+	// The HMAC algorithm of the key. Defaults to "hmac-sha256".
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// The base64-encoded secret
+	Secret string `json:"secret"`
+
+	// What the key may update. Keys without a policy can not update any
+	// records.
+	Update *UpdatePolicy `json:"update,omitempty"`
+}
+
+// The names & types of records a TSIG key may update
+type UpdatePolicy struct {
+	// The names the key may update. A leading "*." allows all subdomains of
+	// a name. If empty, the key may update all names in the served zones.
+	Names []string `json:"names,omitempty"`
+
+	// The record types the key may update. If empty, the key may update all
+	// types except SOA & NS.
+	Types []string `json:"types,omitempty"`
+}
+
+var tsig_algorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Canonicalizes the name & algorithm of the key
+func (k *TSIGKey) provision() error {
+	if k.Name == "" || k.Secret == "" {
+		return fmt.Errorf("TSIG key requires a name and a secret")
+	}
+	k.Name = dns.CanonicalName(k.Name)
+	if k.Algorithm == "" {
+		k.Algorithm = "hmac-sha256"
+	}
+	algorithm, ok := tsig_algorithms[strings.ToLower(strings.TrimSuffix(k.Algorithm, "."))]
+	if !ok {
+		return fmt.Errorf("unsupported TSIG algorithm '%s'", k.Algorithm)
+	}
+	k.Algorithm = algorithm
+	if k.Update != nil {
+		for _, t := range k.Update.Types {
+			if _, ok := dns.StringToType[strings.ToUpper(t)]; !ok {
+				return fmt.Errorf("unknown record type '%s'", t)
+			}
+		}
+	}
+	return nil
+}
+
+// Whether the message is signed with the algorithm of its key. The TSIG
+// verification only uses the algorithm the message claims.
+func tsig_algorithm_matches(tsig *dns.TSIG, keys map[string]*TSIGKey) bool {
+	key, exists := keys[strings.ToLower(tsig.Hdr.Name)]
+	return exists && strings.EqualFold(dns.Fqdn(tsig.Algorithm), key.Algorithm)
+}
+
+func (p *UpdatePolicy) allows(rr dns.RR) bool {
+	name_allowed := len(p.Names) == 0
+	for _, pattern := range p.Names {
+		if matches_name(pattern, rr.Header().Name) {
+			name_allowed = true
+			break
+		}
+	}
+	if !name_allowed {
+		return false
+	}
+	// "delete all RRsets" of a name only deletes the allowed types
+	return rr.Header().Rrtype == dns.TypeANY || p.allows_type(rr.Header().Rrtype)
+}
+
+func (p *UpdatePolicy) allows_type(rrtype uint16) bool {
+	if len(p.Types) == 0 {
+		return rrtype != dns.TypeSOA && rrtype != dns.TypeNS
+	}
+	for _, t := range p.Types {
+		if dns.StringToType[strings.ToUpper(t)] == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether there are any records for the name
+func (srv *Server) name_exists(name string) bool {
+	name = strings.ToLower(name)
+	for key := range srv.Records {
+		if key.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Copies the record with a different class, for comparing RDATA
+func with_class(rr dns.RR, class uint16) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Class = class
+	return rr
+}
+
+// Checks the prerequisites of an update (RFC 2136 section 3.2)
+func (srv *Server) check_prerequisites(zone string, prereqs []dns.RR) int {
+	// "RRset exists (value dependent)" prerequisites, grouped by RRset
+	expected := map[key][]dns.RR{}
+
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		_, exists := srv.Records[rr_key(rr)]
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY {
+				if !srv.name_exists(hdr.Name) {
+					return dns.RcodeNameError
+				}
+			} else if !exists {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rrtype == dns.TypeANY {
+				if srv.name_exists(hdr.Name) {
+					return dns.RcodeYXDomain
+				}
+			} else if exists {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			expected[rr_key(rr)] = append(expected[rr_key(rr)], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for key, rrset := range expected {
+		current := srv.Records[key]
+		if len(current) != len(rrset) {
+			return dns.RcodeNXRrset
+		}
+		for _, rr := range rrset {
+			found := false
+			for _, record := range current {
+				if dns.IsDuplicate(rr, with_class(record, dns.ClassINET)) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Checks the update section before applying it (RFC 2136 section 3.4.1)
+func prescan_updates(zone string, updates []dns.RR, policy *UpdatePolicy) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			if hdr.Rrtype == dns.TypeANY || hdr.Rrtype == dns.TypeAXFR ||
+				hdr.Rrtype == dns.TypeIXFR || hdr.Rrtype == dns.TypeMAILA ||
+				hdr.Rrtype == dns.TypeMAILB {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY, dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Class == dns.ClassNONE && hdr.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+		if !policy.allows(rr) {
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Applies the update section (RFC 2136 section 3.4.2)
+func (srv *Server) apply_updates(zone string, updates []dns.RR, policy *UpdatePolicy) (added int, deleted int) {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		key := rr_key(rr)
+		switch hdr.Class {
+		case dns.ClassINET:
+			if hdr.Rrtype == dns.TypeSOA {
+				// the SOA is managed by the configuration
+				continue
+			}
+			_, has_cname := srv.Records[key_of(hdr.Name, dns.TypeCNAME)]
+			if has_cname != (hdr.Rrtype == dns.TypeCNAME) && srv.name_exists(hdr.Name) {
+				// CNAMEs can't coexist with other data
+				continue
+			}
+			current := srv.Records[key]
+			replaced := false
+			for i, record := range current {
+				if dns.IsDuplicate(rr, record) || hdr.Rrtype == dns.TypeCNAME {
+					srv.track([]dns.RR{rr}, []dns.RR{record})
+					current[i] = rr
+					replaced = true
+				}
+			}
+			if !replaced {
+				srv.insert_record(rr)
+				added += 1
+			}
+		case dns.ClassANY:
+			for existing := range srv.Records {
+				if existing.Name != key.Name {
+					continue
+				}
+				if hdr.Rrtype != dns.TypeANY && existing.Type != key.Type {
+					continue
+				}
+				if !policy.allows_type(uint16(existing.Type)) {
+					continue
+				}
+				if strings.EqualFold(key.Name, zone) &&
+					(existing.Type == dns.Type(dns.TypeSOA) || existing.Type == dns.Type(dns.TypeNS)) {
+					// the apex SOA & NS are managed by the configuration
+					continue
+				}
+				deleted += len(srv.Records[existing])
+				srv.track(nil, srv.Records[existing])
+				delete(srv.Records, existing)
+			}
+		case dns.ClassNONE:
+			// the TTL of the record to delete doesn't matter
+			rr = with_class(rr, dns.ClassINET)
+			for _, record := range srv.Records[key] {
+				if dns.IsDuplicate(rr, record) && srv.delete_record(record) {
+					deleted += 1
+					break
+				}
+			}
+		}
+	}
+	return added, deleted
+}
+
+// Handles a dynamic update (RFC 2136), authenticated with TSIG
+func (srv *Server) handle_update(q query) {
+	m := new(dns.Msg)
+	m.SetReply(q.r)
+
+	tsig := q.r.IsTsig()
+	respond := func(code int, reason string) {
+		m.Rcode = code
+		if tsig != nil && q.w.TsigStatus() == nil && tsig_algorithm_matches(tsig, srv.Keys) {
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+		}
+		srv.logger.Debug(
+			"answering update",
+			zap.Stringer("address", q.w.RemoteAddr()),
+			zap.String("reason", reason),
+			zap.Object("response", LoggableDNSMsg{m}),
+		)
+		q.w.WriteMsg(m)
+	}
+
+	if tsig == nil {
+		respond(dns.RcodeRefused, "update not signed")
+		return
+	}
+	if err := q.w.TsigStatus(); err != nil {
+		respond(dns.RcodeNotAuth, "TSIG verification failed: "+err.Error())
+		return
+	}
+	if !tsig_algorithm_matches(tsig, srv.Keys) {
+		respond(dns.RcodeNotAuth, "wrong TSIG algorithm")
+		return
+	}
+	tsig_key, exists := srv.Keys[strings.ToLower(tsig.Hdr.Name)]
+	if !exists || tsig_key.Update == nil {
+		respond(dns.RcodeRefused, "key may not update")
+		return
+	}
+
+	zone := q.r.Question[0]
+	if zone.Qtype != dns.TypeSOA || zone.Qclass != dns.ClassINET {
+		respond(dns.RcodeFormatError, "invalid zone section")
+		return
+	}
+	zone_name, authoritative := "", false
+	for _, z := range srv.Zones {
+		if strings.EqualFold(z, zone.Name) {
+			zone_name, authoritative = z, true
+		}
+	}
+	if !authoritative {
+		respond(dns.RcodeNotAuth, "not authoritative for zone")
+		return
+	}
+	if _, secondary := srv.secondaries[zone_name]; secondary {
+		// the next transfer would overwrite the update
+		respond(dns.RcodeRefused, "secondary zone")
+		return
+	}
+
+	if code := srv.check_prerequisites(zone_name, q.r.Answer); code != dns.RcodeSuccess {
+		respond(code, "prerequisites not met")
+		return
+	}
+	if code := prescan_updates(zone_name, q.r.Ns, tsig_key.Update); code != dns.RcodeSuccess {
+		respond(code, "invalid update")
+		return
+	}
+	added, deleted := srv.apply_updates(zone_name, q.r.Ns, tsig_key.Update)
+	srv.commit_changes()
+	srv.logger.Info(
+		"applied update",
+		zap.String("zone", zone_name),
+		zap.String("key", tsig_key.Name),
+		zap.Int("added_records", added),
+		zap.Int("deleted_records", deleted),
+	)
+	respond(dns.RcodeSuccess, "updated")
+}
+
+// Parses a "tsig_key" subdirective. Syntax:
+//
+//	tsig_key <name> <secret> {
+//	    [algorithm <algorithm>]
+//	    [update]
+//	    [update_names <name...>]
+//	    [update_types <type...>]
+//	}
+func (k *TSIGKey) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return d.ArgErr()
+	}
+	k.Name, k.Secret = args[0], args[1]
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "algorithm":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			k.Algorithm = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "update":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if k.Update == nil {
+				k.Update = &UpdatePolicy{}
+			}
+		case "update_names", "update_types":
+			option := d.Val()
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return d.ArgErr()
+			}
+			if k.Update == nil {
+				k.Update = &UpdatePolicy{}
+			}
+			if option == "update_names" {
+				k.Update.Names = append(k.Update.Names, values...)
+			} else {
+				k.Update.Types = append(k.Update.Types, values...)
+			}
+		default:
+			return d.Errf("unrecognized TSIG key subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
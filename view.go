@@ -0,0 +1,126 @@
+package stub
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Records that are served to the clients on some networks instead of the
+// records of the same name & type (split-horizon DNS), e.g. private
+// addresses for internal clients. All other records, including those of
+// the ACME challenge, are served in every view.
+type View struct {
+	// The name of the view, for logging
+	Name string `json:"name,omitempty"`
+
+	// The networks (in CIDR notation) or addresses of the clients that
+	// receive the view
+	Networks []string `json:"networks"`
+
+	// The records of the view. Placeholders are expanded when the app is
+	// provisioned.
+	Records []string `json:"records,omitempty"`
+
+	networks  []*net.IPNet     // set in provision()
+	overrides map[key][]dns.RR // set in provision()
+	merged    map[key][]dns.RR // owned by Server.main(), reset on changes
+}
+
+func (v *View) provision() error {
+	if len(v.Networks) == 0 {
+		return fmt.Errorf("view '%s' requires networks", v.Name)
+	}
+	networks, err := parse_networks(v.Networks)
+	if err != nil {
+		return err
+	}
+	v.networks = networks
+	records, err := parse_records(v.Records)
+	if err != nil {
+		return err
+	}
+	v.overrides = map[key][]dns.RR{}
+	for _, record := range records {
+		k := rr_key(record.rr)
+		v.overrides[k] = append(v.overrides[k], record.rr)
+	}
+	return nil
+}
+
+// The records served in the view: the records of the server, with the
+// RRsets of the view replacing those of the same name & type
+func (v *View) records(global map[key][]dns.RR) map[key][]dns.RR {
+	if v.merged != nil {
+		return v.merged
+	}
+	v.merged = make(map[key][]dns.RR, len(global)+len(v.overrides))
+	for k, rrset := range global {
+		v.merged[k] = rrset
+	}
+	for k, rrset := range v.overrides {
+		v.merged[k] = rrset
+	}
+	return v.merged
+}
+
+// The first view that includes the address of the client, if any
+func (srv *Server) view_of(client net.IP) *View {
+	for _, view := range srv.views {
+		if networks_contain(view.networks, client) {
+			return view
+		}
+	}
+	return nil
+}
+
+// Serves the records of the client's view (if any) while handling the
+// query. Returns a function that restores the records of the server.
+func (srv *Server) enter_view(view *View) func() {
+	if view == nil {
+		return func() {}
+	}
+	srv.logger.Debug("serving view", zap.String("view", view.Name))
+	global := srv.Records
+	srv.Records = view.records(global)
+	return func() { srv.Records = global }
+}
+
+// Parses a "view" subdirective. Syntax:
+//
+//	view [<name>] {
+//	    network <network...>
+//	    [record "<record>"]
+//	}
+func (v *View) unmarshal_caddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		v.Name = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "network":
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return d.ArgErr()
+			}
+			v.Networks = append(v.Networks, values...)
+		case "record":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v.Records = append(v.Records, d.Val())
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized view subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}